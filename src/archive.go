@@ -0,0 +1,612 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	archiveWorkers    = 4
+	maxArchiveWorkers = 16
+	// archiveReadRetries is how many times a GET that breaks in the middle
+	// of an object is resumed with a ranged request.
+	archiveReadRetries = 3
+)
+
+// archiver writes entries of one archive format to a stream. Entries are
+// written one at a time and never buffered whole.
+type archiver interface {
+	// add writes o as name; body is nil for folder markers.
+	add(o objInfo, name string, body io.Reader) error
+	close() error
+}
+
+type archiveFormat struct {
+	ext         string
+	contentType string
+	new         func(w io.Writer) (archiver, error)
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip":     {".zip", "application/zip", newZipArchiver},
+	"tar":     {".tar", "application/x-tar", newTarArchiver},
+	"tar.gz":  {".tar.gz", "application/gzip", newTarGzArchiver},
+	"tar.zst": {".tar.zst", "application/zstd", newTarZstdArchiver},
+}
+
+// zipArchiver stores objects without compressing them, most of what lives
+// in a bucket (media, archives) being compressed already. Zip64 records are
+// written by archive/zip when an entry or the archive outgrows 4 GiB or
+// 65535 entries.
+type zipArchiver struct{ zw *zip.Writer }
+
+func newZipArchiver(w io.Writer) (archiver, error) { return &zipArchiver{zw: zip.NewWriter(w)}, nil }
+
+func (a *zipArchiver) add(o objInfo, name string, body io.Reader) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Store, Modified: o.LastModified}
+	if body == nil {
+		fh.Name = strings.TrimSuffix(name, "/") + "/"
+		fh.SetMode(fs.ModeDir | 0o755)
+	} else {
+		fh.SetMode(0o644)
+	}
+	fw, err := a.zw.CreateHeader(fh)
+	if err != nil || body == nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}
+
+func (a *zipArchiver) close() error { return a.zw.Close() }
+
+// tarArchiver writes a tar stream, optionally through a compressor. Sizes
+// come from the listing; the ETag check of the GET makes sure the object
+// still has that size.
+type tarArchiver struct {
+	tw *tar.Writer
+	zw io.WriteCloser
+}
+
+func newTarArchiver(w io.Writer) (archiver, error) { return &tarArchiver{tw: tar.NewWriter(w)}, nil }
+
+func newTarGzArchiver(w io.Writer) (archiver, error) {
+	zw := gzip.NewWriter(w)
+	return &tarArchiver{tw: tar.NewWriter(zw), zw: zw}, nil
+}
+
+func newTarZstdArchiver(w io.Writer) (archiver, error) {
+	// One encoder goroutine per request keeps the memory of each download
+	// bounded; the window stays the default 8 MiB.
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiver{tw: tar.NewWriter(zw), zw: zw}, nil
+}
+
+func (a *tarArchiver) add(o objInfo, name string, body io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0o644, Size: o.Size, ModTime: o.LastModified, Typeflag: tar.TypeReg}
+	if body == nil {
+		hdr.Name, hdr.Mode, hdr.Size, hdr.Typeflag = strings.TrimSuffix(name, "/")+"/", 0o755, 0, tar.TypeDir
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil || body == nil {
+		return err
+	}
+	n, err := io.Copy(a.tw, body)
+	if err == nil && n != o.Size {
+		err = fmt.Errorf("read %d bytes, listed %d", n, o.Size)
+	}
+	return err
+}
+
+func (a *tarArchiver) close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.zw != nil {
+		return a.zw.Close()
+	}
+	return nil
+}
+
+// archiveName returns the path of rel inside an archive, refusing names that
+// would escape the extraction folder.
+func archiveName(rel string) (string, bool) {
+	rel = strings.TrimLeft(rel, "/")
+	if rel == "" {
+		return "", false
+	}
+	for _, seg := range strings.Split(strings.TrimSuffix(rel, "/"), "/") {
+		if seg == ".." || seg == "." {
+			return "", false
+		}
+	}
+	return rel, true
+}
+
+func archiveConcurrency(n int) int {
+	if n <= 0 {
+		return archiveWorkers
+	}
+	return min(n, maxArchiveWorkers)
+}
+
+// openObject starts a GET of key from offset. With etag, an object replaced
+// since it was listed answers errNotFound rather than different bytes.
+func (p *proxy) openObject(ctx context.Context, bucket, key, etag string, offset int64) (io.ReadCloser, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, p.objectURL(bucket, key), nil)
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK && offset == 0, resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, errNotFound
+	case http.StatusPreconditionFailed:
+		return nil, fmt.Errorf("%w (changed since listed)", errNotFound)
+	}
+	return nil, fmt.Errorf("get failed: %s", resp.Status)
+}
+
+// objectReader reads an object, resuming with a ranged GET when the
+// connection breaks in the middle of the body.
+type objectReader struct {
+	p           *proxy
+	ctx         context.Context
+	bucket, key string
+	etag        string
+	body        io.ReadCloser
+	off         int64
+	retries     int
+}
+
+func (r *objectReader) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	r.off += int64(n)
+	if err == nil || err == io.EOF || r.retries >= archiveReadRetries || r.ctx.Err() != nil {
+		return n, err
+	}
+	r.retries++
+	r.body.Close()
+	body, rerr := r.p.openObject(r.ctx, r.bucket, r.key, r.etag, r.off)
+	if rerr != nil {
+		r.body = io.NopCloser(strings.NewReader(""))
+		return n, fmt.Errorf("%s: %v (resume: %v)", r.key, err, rerr)
+	}
+	r.body = body
+	return n, nil
+}
+
+func (r *objectReader) Close() error { return r.body.Close() }
+
+type archiveItem struct {
+	obj  objInfo
+	name string
+	body io.ReadCloser
+	err  error
+	done chan struct{}
+}
+
+// writeArchive writes the objects that walk yields to a, leaving it open for
+// more entries. GETs are started up to workers objects ahead of the one
+// being written so that S3 latency is hidden, while memory stays bounded by
+// the open responses. begin is called before the first byte is written.
+// Objects deleted or replaced since they were listed are skipped and
+// returned.
+func (p *proxy) writeArchive(ctx context.Context, bucket string, a archiver, workers int, begin func(), walk func(yield func(o objInfo, name string) error) error) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queue := make(chan *archiveItem, workers)
+	var walkErr error
+	go func() {
+		defer close(queue)
+		walkErr = walk(func(o objInfo, name string) error {
+			it := &archiveItem{obj: o, name: name, done: make(chan struct{})}
+			if strings.HasSuffix(name, "/") {
+				close(it.done)
+			} else {
+				go func() {
+					defer close(it.done)
+					it.err = withRetry(ctx, func() error {
+						body, err := p.openObject(ctx, bucket, o.Key, o.ETag, 0)
+						it.body = body
+						return err
+					})
+				}()
+			}
+			select {
+			case queue <- it:
+				return nil
+			case <-ctx.Done():
+				<-it.done
+				if it.body != nil {
+					it.body.Close()
+				}
+				return ctx.Err()
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		for it := range queue {
+			<-it.done
+			if it.body != nil {
+				it.body.Close()
+			}
+		}
+	}()
+
+	var missing []string
+	for it := range queue {
+		<-it.done
+		if errors.Is(it.err, errNotFound) {
+			missing = append(missing, it.obj.Key)
+			continue
+		}
+		if it.err != nil {
+			return missing, fmt.Errorf("%s: %w", it.obj.Key, it.err)
+		}
+		begin()
+		var body io.Reader
+		if it.body != nil {
+			rd := &objectReader{p: p, ctx: ctx, bucket: bucket, key: it.obj.Key, etag: it.obj.ETag, body: it.body}
+			it.body, body = rd, rd
+		}
+		err := a.add(it.obj, it.name, body)
+		if it.body != nil {
+			it.body.Close()
+		}
+		if err != nil {
+			return missing, fmt.Errorf("%s: %w", it.obj.Key, err)
+		}
+	}
+	return missing, walkErr
+}
+
+// archiveStream sends an archive as the response, once there is something
+// to send, so that errors found early can still be answered with a status.
+type archiveStream struct {
+	w        http.ResponseWriter
+	format   archiveFormat
+	filename string
+	started  bool
+}
+
+func (s *archiveStream) begin() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", s.format.contentType)
+	s.w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": s.filename + s.format.ext}))
+	s.w.Header().Set("Cache-Control", "no-store")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// fail answers 502 if nothing was sent yet. Otherwise the archive is
+// truncated: the connection is aborted so that the client does not take it
+// for a complete download.
+func (s *archiveStream) fail(what string, err error) {
+	if !s.started {
+		http.Error(s.w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("archive %s: %v", what, err)
+	panic(http.ErrAbortHandler)
+}
+
+func archiveFormatFor(w http.ResponseWriter, name string) (archiveFormat, bool) {
+	if name == "" {
+		name = "zip"
+	}
+	format, ok := archiveFormats[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown archive format %q", name), http.StatusBadRequest)
+	}
+	return format, ok
+}
+
+// handleArchive streams objects as a single archive built on the fly,
+// without holding the objects or the listing in memory: every object under
+// prefix for GET, a selection of keys and prefixes for POST.
+func (p *proxy) handleArchive(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p.archivePrefix(w, r)
+	case http.MethodPost:
+		p.archiveSelection(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// archivePrefix leaves the trash out unless prefix is inside it; exclude
+// drops sub-folders like in /api/list.
+func (p *proxy) archivePrefix(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := p.requestBucket(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	prefix, err := cleanKey(q.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix = strings.TrimLeft(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	format, ok := archiveFormatFor(w, q.Get("format"))
+	if !ok {
+		return
+	}
+	id := identityFrom(r.Context())
+	if !p.policy.visible(id, bucket, prefix) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	excludes := parseExcludes(r)
+	skipTrash := !p.inTrash(prefix)
+	workers, _ := strconv.Atoi(q.Get("concurrency"))
+
+	s := &archiveStream{w: w, format: format, filename: path.Base(strings.TrimSuffix(prefix, "/"))}
+	if prefix == "" {
+		s.filename = bucket
+	}
+	a, err := format.new(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	missing, err := p.writeArchive(r.Context(), bucket, a, archiveConcurrency(workers), s.begin, func(yield func(objInfo, string) error) error {
+		return p.walkObjects(r.Context(), bucket, prefix, func(o objInfo) error {
+			rel := strings.TrimPrefix(o.Key, prefix)
+			if (skipTrash && p.inTrash(o.Key)) || p.skipThumb(prefix, o.Key) || isExcluded(rel, excludes) || !p.policy.allowed(id, actRead, bucket, o.Key) {
+				return nil
+			}
+			if strings.HasSuffix(o.Key, "/") && o.Size != 0 {
+				return nil
+			}
+			name, ok := archiveName(rel)
+			if !ok {
+				return nil
+			}
+			return yield(o, name)
+		})
+	})
+	if len(missing) > 0 {
+		log.Printf("archive %s/%s: %d object(s) vanished while archiving", bucket, prefix, len(missing))
+	}
+	if err == nil {
+		s.begin()
+		err = a.close()
+	}
+	if err != nil {
+		s.fail(bucket+"/"+prefix, err)
+	}
+}
+
+const (
+	maxArchiveKeys = 10000
+	// missingManifest is added at the end of a selection archive when some
+	// of the requested keys could not be included.
+	missingManifest = "_missing.json"
+)
+
+type archiveRequest struct {
+	Bucket      string   `json:"bucket,omitempty"`
+	Keys        []string `json:"keys"` // keys, and prefixes ending with "/"
+	Format      string   `json:"format,omitempty"`
+	Flatten     bool     `json:"flatten,omitempty"`
+	Root        string   `json:"root,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+}
+
+// archiveBase returns the folder shared by every key, which is left out of
+// the names in the archive.
+func archiveBase(keys []string) string {
+	var base string
+	for i, k := range keys {
+		dir := k[:strings.LastIndex(strings.TrimSuffix(k, "/"), "/")+1]
+		if i == 0 {
+			base = dir
+			continue
+		}
+		for !strings.HasPrefix(dir, base) {
+			base = base[:strings.LastIndex(strings.TrimSuffix(base, "/"), "/")+1]
+		}
+	}
+	return base
+}
+
+// uniqueName makes name unused in seen, numbering it like "a (2).txt".
+func uniqueName(seen map[string]bool, name string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 2; seen[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+	seen[name] = true
+	return name
+}
+
+// archiveSelection archives the keys and prefixes of the request. Names are
+// relative to the folder the keys share, or just the file names with
+// flatten (numbered on collision), all under root when set. Keys that do not
+// exist, prefixes without objects and objects deleted while archiving are
+// listed in a trailing missingManifest.
+func (p *proxy) archiveSelection(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req archiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, req.Bucket)
+	if !ok {
+		return
+	}
+	if req.Format == "" {
+		req.Format = r.URL.Query().Get("format")
+	}
+	format, ok := archiveFormatFor(w, req.Format)
+	if !ok {
+		return
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > maxArchiveKeys {
+		http.Error(w, fmt.Sprintf("between 1 and %d keys are required", maxArchiveKeys), http.StatusBadRequest)
+		return
+	}
+	root := ""
+	if req.Root != "" {
+		var ok bool
+		if root, ok = archiveName(strings.Trim(req.Root, "/")); !ok {
+			http.Error(w, "invalid root", http.StatusBadRequest)
+			return
+		}
+		root += "/"
+	}
+	id := identityFrom(ctx)
+	keys := make([]string, 0, len(req.Keys))
+	for _, k := range req.Keys {
+		k, err := cleanKey(k)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if k = strings.TrimLeft(k, "/"); k == "" {
+			http.Error(w, "empty key", http.StatusBadRequest)
+			return
+		}
+		allowed := p.policy.allowed(id, actRead, bucket, k)
+		if strings.HasSuffix(k, "/") {
+			allowed = p.policy.visible(id, bucket, k)
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("forbidden: %s", k), http.StatusForbidden)
+			return
+		}
+		keys = append(keys, k)
+	}
+	base := archiveBase(keys)
+
+	seen := map[string]bool{}
+	entryName := func(key string) (string, bool) {
+		rel := strings.TrimPrefix(key, base)
+		if req.Flatten {
+			if strings.HasSuffix(key, "/") {
+				return "", false
+			}
+			rel = path.Base(key)
+		}
+		name, ok := archiveName(rel)
+		if !ok {
+			return "", false
+		}
+		name = root + name
+		if !req.Flatten && seen[name] {
+			return "", false
+		}
+		return uniqueName(seen, name), true
+	}
+
+	s := &archiveStream{w: w, format: format, filename: strings.TrimSuffix(root, "/")}
+	if s.filename == "" {
+		s.filename = "archive"
+	}
+	a, err := format.new(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var absent []string
+	vanished, err := p.writeArchive(ctx, bucket, a, archiveConcurrency(req.Concurrency), s.begin, func(yield func(objInfo, string) error) error {
+		for _, k := range keys {
+			if !strings.HasSuffix(k, "/") {
+				h, err := p.headObject(ctx, bucket, k)
+				if errors.Is(err, errNotFound) {
+					absent = append(absent, k)
+					continue
+				} else if err != nil {
+					return fmt.Errorf("%s: %w", k, err)
+				}
+				if name, ok := entryName(k); ok {
+					if err := yield(objInfo{Key: k, Size: h.Size, LastModified: h.LastModified, ETag: h.ETag}, name); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			skipTrash := !p.inTrash(k)
+			found := false
+			err := p.walkObjects(ctx, bucket, k, func(o objInfo) error {
+				if (skipTrash && p.inTrash(o.Key)) || p.skipThumb(k, o.Key) || !p.policy.allowed(id, actRead, bucket, o.Key) {
+					return nil
+				}
+				if strings.HasSuffix(o.Key, "/") && o.Size != 0 {
+					return nil
+				}
+				found = true
+				name, ok := entryName(o.Key)
+				if !ok {
+					return nil
+				}
+				return yield(o, name)
+			})
+			if err != nil {
+				return err
+			}
+			if !found {
+				absent = append(absent, k)
+			}
+		}
+		return nil
+	})
+	if err == nil && len(absent)+len(vanished) > 0 {
+		missing := append(absent, vanished...)
+		b, _ := json.MarshalIndent(map[string][]string{"missing": missing}, "", "  ")
+		s.begin()
+		o := objInfo{Key: missingManifest, Size: int64(len(b)), LastModified: time.Now().UTC()}
+		err = a.add(o, uniqueName(seen, root+missingManifest), bytes.NewReader(b))
+	}
+	if err == nil {
+		s.begin()
+		err = a.close()
+	}
+	if err != nil {
+		s.fail(bucket, err)
+	}
+}
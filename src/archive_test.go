@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestArchiveBase(t *testing.T) {
+	for _, tc := range []struct {
+		keys []string
+		want string
+	}{
+		{[]string{"a.txt"}, ""},
+		{[]string{"docs/a.txt"}, "docs/"},
+		{[]string{"docs/"}, ""},
+		{[]string{"docs/sub/"}, "docs/"},
+		{[]string{"docs/a.txt", "docs/b.txt"}, "docs/"},
+		{[]string{"docs/a/x.txt", "docs/b/y.txt"}, "docs/"},
+		{[]string{"docs/a/x.txt", "docs/"}, ""},
+		{[]string{"docs/bc/x", "docs/b/y"}, "docs/"},
+		{[]string{"docs/b/y", "docs/bc/x"}, "docs/"},
+		{[]string{"docs/a.txt", "img/b.png"}, ""},
+		{[]string{"a/b/c/d.txt", "a/b/e.txt", "a/b/c/"}, "a/b/"},
+	} {
+		if got := archiveBase(tc.keys); got != tc.want {
+			t.Errorf("archiveBase(%q) = %q, want %q", tc.keys, got, tc.want)
+		}
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	seen := map[string]bool{}
+	for _, tc := range []struct{ name, want string }{
+		{"a.txt", "a.txt"},
+		{"a.txt", "a (2).txt"},
+		{"a.txt", "a (3).txt"},
+		{"a (2).txt", "a (2) (2).txt"},
+		{"dir/", "dir/"},
+		{"b", "b"},
+		{"b", "b (2)"},
+	} {
+		if got := uniqueName(seen, tc.name); got != tc.want {
+			t.Errorf("uniqueName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
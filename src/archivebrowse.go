@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	archiveEntriesMax    = 10000
+	maxArchiveEntriesMax = 100000
+	// rangeSkip is how far ahead a rangeReaderAt reads and discards rather
+	// than starting a new ranged GET.
+	rangeSkip = 1 << 20
+)
+
+// rangeReaderAt reads an object with ranged GETs. Sequential reads share one
+// open-ended GET; a read elsewhere starts a new one, so that the central
+// directory of a ZIP or the headers of a tar cost a few requests whatever
+// the size of the object.
+type rangeReaderAt struct {
+	p           *proxy
+	ctx         context.Context
+	bucket, key string
+	etag        string
+	size        int64
+
+	mu   sync.Mutex
+	body io.ReadCloser
+	pos  int64
+}
+
+func (r *rangeReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && off > r.pos && off-r.pos <= rangeSkip {
+		if _, err := io.CopyN(io.Discard, r.body, off-r.pos); err != nil {
+			r.close()
+		} else {
+			r.pos = off
+		}
+	}
+	if r.body == nil || off != r.pos {
+		r.close()
+		body, err := r.p.openObject(r.ctx, r.bucket, r.key, r.etag, off)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.pos = body, off
+	}
+	n, err := io.ReadFull(r.body, b[:min(int64(len(b)), r.size-off)])
+	r.pos += int64(n)
+	if err != nil {
+		r.close()
+		return n, err
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rangeReaderAt) close() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+func (r *rangeReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.close()
+	return nil
+}
+
+type archiveEntry struct {
+	Name           string    `json:"name"`
+	Size           int64     `json:"size"`
+	CompressedSize int64     `json:"compressedSize,omitempty"`
+	Modified       time.Time `json:"modified"`
+	Dir            bool      `json:"dir,omitempty"`
+}
+
+type archiveEntriesResponse struct {
+	Key       string         `json:"key"`
+	Format    string         `json:"format"`
+	Entries   []archiveEntry `json:"entries"`
+	Truncated bool           `json:"truncated"`
+}
+
+var errNotArchive = errors.New("not a ZIP or tar archive")
+
+// storedArchive is an archive object opened for reading: zr for a ZIP,
+// otherwise a tar stream (tr) read through its decompressor.
+type storedArchive struct {
+	format string
+	ra     *rangeReaderAt
+	zr     *zip.Reader
+	tr     *tar.Reader
+	closer func()
+}
+
+func (a *storedArchive) Close() {
+	if a.closer != nil {
+		a.closer()
+	}
+	a.ra.Close()
+}
+
+// openArchive recognizes a ZIP or a (compressed) tar from its first bytes.
+// A ZIP is read from its central directory with ranged GETs; a tar is
+// streamed from the start, skipping the content of plain tars with ranges.
+func (p *proxy) openArchive(ctx context.Context, bucket, key string) (*storedArchive, error) {
+	h, err := p.headObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	ra := &rangeReaderAt{p: p, ctx: ctx, bucket: bucket, key: key, etag: h.ETag, size: h.Size}
+	head := make([]byte, 512)
+	n, err := ra.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		ra.Close()
+		return nil, err
+	}
+	head = head[:n]
+	a := &storedArchive{ra: ra}
+	section := io.NewSectionReader(ra, 0, h.Size)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")), strings.EqualFold(path.Ext(key), ".zip"):
+		a.format = "zip"
+		if a.zr, err = zip.NewReader(ra, h.Size); err != nil {
+			ra.Close()
+			return nil, fmt.Errorf("%w: %v", errNotArchive, err)
+		}
+		return a, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(section)
+		if err != nil {
+			ra.Close()
+			return nil, fmt.Errorf("%w: %v", errNotArchive, err)
+		}
+		a.format, a.tr, a.closer = "tar.gz", tar.NewReader(zr), func() { zr.Close() }
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(section, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			ra.Close()
+			return nil, err
+		}
+		a.format, a.tr, a.closer = "tar.zst", tar.NewReader(zr), zr.Close
+	case bytes.HasPrefix(head, []byte("BZh")):
+		a.format, a.tr = "tar.bz2", tar.NewReader(bzip2.NewReader(section))
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		// The section is seekable, which lets tar skip file contents.
+		a.format, a.tr = "tar", tar.NewReader(section)
+	default:
+		ra.Close()
+		return nil, errNotArchive
+	}
+	return a, nil
+}
+
+// entries lists up to max entries, reporting whether there were more.
+func (a *storedArchive) entries(max int) ([]archiveEntry, bool, error) {
+	out := []archiveEntry{}
+	if a.zr != nil {
+		for _, f := range a.zr.File {
+			if len(out) == max {
+				return out, true, nil
+			}
+			out = append(out, archiveEntry{Name: f.Name, Size: int64(f.UncompressedSize64), CompressedSize: int64(f.CompressedSize64), Modified: f.Modified.UTC(), Dir: f.FileInfo().IsDir()})
+		}
+		return out, false, nil
+	}
+	for {
+		hdr, err := a.tr.Next()
+		if err == io.EOF {
+			return out, false, nil
+		}
+		if err != nil {
+			if len(out) == 0 {
+				err = fmt.Errorf("%w: %v", errNotArchive, err)
+			}
+			return out, false, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		if len(out) == max {
+			return out, true, nil
+		}
+		out = append(out, archiveEntry{Name: hdr.Name, Size: hdr.Size, Modified: hdr.ModTime.UTC(), Dir: hdr.Typeflag == tar.TypeDir})
+	}
+}
+
+// entry opens the file called name inside the archive.
+func (a *storedArchive) entry(name string) (io.ReadCloser, archiveEntry, error) {
+	if a.zr != nil {
+		for _, f := range a.zr.File {
+			if f.Name != name || f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			return rc, archiveEntry{Name: f.Name, Size: int64(f.UncompressedSize64), Modified: f.Modified.UTC()}, err
+		}
+		return nil, archiveEntry{}, errNotFound
+	}
+	for {
+		hdr, err := a.tr.Next()
+		if err == io.EOF {
+			return nil, archiveEntry{}, errNotFound
+		}
+		if err != nil {
+			return nil, archiveEntry{}, err
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Name == name {
+			return io.NopCloser(a.tr), archiveEntry{Name: hdr.Name, Size: hdr.Size, Modified: hdr.ModTime.UTC()}, nil
+		}
+	}
+}
+
+// readTarget reads the key of a GET such as /api/archive-entries or
+// /api/thumb and checks that the caller may read it.
+func (p *proxy) readTarget(w http.ResponseWriter, r *http.Request) (bucket, key string, ok bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return "", "", false
+	}
+	if bucket, ok = p.requestBucket(w, r); !ok {
+		return "", "", false
+	}
+	key, err := cleanKey(r.URL.Query().Get("key"))
+	if key = strings.TrimLeft(key, "/"); err != nil || key == "" {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return "", "", false
+	}
+	if !p.authorize(w, r, actRead, bucket, key) {
+		return "", "", false
+	}
+	return bucket, key, true
+}
+
+func writeArchiveError(w http.ResponseWriter, key string, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, fmt.Sprintf("%s not found", key), http.StatusNotFound)
+	case errors.Is(err, errNotArchive), errors.Is(err, zip.ErrAlgorithm), errors.Is(err, zip.ErrFormat):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleArchiveEntries lists the files inside a ZIP or tar object.
+func (p *proxy) handleArchiveEntries(w http.ResponseWriter, r *http.Request) {
+	bucket, key, ok := p.readTarget(w, r)
+	if !ok {
+		return
+	}
+	max := archiveEntriesMax
+	if n, err := strconv.Atoi(r.URL.Query().Get("max")); err == nil && n > 0 {
+		max = min(n, maxArchiveEntriesMax)
+	}
+	a, err := p.openArchive(r.Context(), bucket, key)
+	if err != nil {
+		writeArchiveError(w, key, err)
+		return
+	}
+	defer a.Close()
+	entries, truncated, err := a.entries(max)
+	if err != nil {
+		writeArchiveError(w, key, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(archiveEntriesResponse{Key: key, Format: a.format, Entries: entries, Truncated: truncated})
+}
+
+// handleArchiveEntry streams one file out of a ZIP or tar object, inline,
+// so that the browser can preview it.
+func (p *proxy) handleArchiveEntry(w http.ResponseWriter, r *http.Request) {
+	bucket, key, ok := p.readTarget(w, r)
+	if !ok {
+		return
+	}
+	name := r.URL.Query().Get("entry")
+	if name == "" {
+		http.Error(w, "entry is required", http.StatusBadRequest)
+		return
+	}
+	a, err := p.openArchive(r.Context(), bucket, key)
+	if err != nil {
+		writeArchiveError(w, key, err)
+		return
+	}
+	defer a.Close()
+	rc, e, err := a.entry(name)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("%s not found in %s", name, key), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeArchiveError(w, key, err)
+		return
+	}
+	defer rc.Close()
+	ct := mime.TypeByExtension(path.Ext(name))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": path.Base(name)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Archives come from anyone who can upload: keep their HTML away from
+	// the origin of the UI.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if !e.Modified.IsZero() {
+		w.Header().Set("Last-Modified", e.Modified.Format(http.TimeFormat))
+	}
+	_, _ = io.Copy(w, rc)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookieName = "s3b_session"
+
+type identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+}
+
+type identityCtxKey struct{}
+
+func withIdentity(ctx context.Context, id *identity) context.Context {
+	return context.WithValue(ctx, identityCtxKey{}, id)
+}
+
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityCtxKey{}).(*identity)
+	return id
+}
+
+// authProvider is one way of proving who the caller is. It returns nil when
+// the request carries no (valid) credentials for this provider.
+type authProvider interface {
+	authenticate(r *http.Request) *identity
+}
+
+type basicProvider struct {
+	users map[string][]byte
+}
+
+// dummyHash keeps the bcrypt cost constant for unknown users so the response
+// time does not reveal which names exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("s3-browser"), bcrypt.DefaultCost)
+
+func (b *basicProvider) check(name, password string) bool {
+	h, ok := b.users[name]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+func (b *basicProvider) authenticate(r *http.Request) *identity {
+	name, password, ok := r.BasicAuth()
+	if !ok || !b.check(name, password) {
+		return nil
+	}
+	return &identity{Name: name, Method: "basic"}
+}
+
+type tokenProvider struct {
+	tokens map[string]string
+}
+
+func (t *tokenProvider) authenticate(r *http.Request) *identity {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return nil
+	}
+	got := []byte(strings.TrimSpace(h[7:]))
+	for name, tok := range t.tokens {
+		if subtle.ConstantTimeCompare(got, []byte(tok)) == 1 {
+			return &identity{Name: name, Method: "token"}
+		}
+	}
+	return nil
+}
+
+type sessionProvider struct {
+	secret []byte
+	ttl    time.Duration
+	users  map[string][]byte
+}
+
+func (s *sessionProvider) sign(payload string) string {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func (s *sessionProvider) issue(name string) (string, time.Time) {
+	exp := time.Now().Add(s.ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(name + "|" + strconv.FormatInt(exp.Unix(), 10)))
+	return payload + "." + s.sign(payload), exp
+}
+
+func (s *sessionProvider) authenticate(r *http.Request) *identity {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil
+	}
+	name, expStr, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil
+	}
+	if _, ok := s.users[name]; !ok {
+		return nil
+	}
+	return &identity{Name: name, Method: "session"}
+}
+
+type authenticator struct {
+	providers []authProvider
+	basic     *basicProvider
+	sessions  *sessionProvider
+}
+
+func readCredentialFile(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := map[string]string{}
+	sc := bufio.NewScanner(f)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, secret, ok := strings.Cut(line, ":")
+		name, secret = strings.TrimSpace(name), strings.TrimSpace(secret)
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:secret", p, n)
+		}
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate entry %q", p, n, name)
+		}
+		out[name] = secret
+	}
+	return out, sc.Err()
+}
+
+var (
+	processSecretOnce sync.Once
+	processSecretVal  []byte
+	processSecretErr  error
+)
+
+// processSecret is the random session key used when none is configured. It
+// is generated once so sessions survive configuration reloads.
+func processSecret() ([]byte, error) {
+	processSecretOnce.Do(func() {
+		processSecretVal = make([]byte, 32)
+		_, processSecretErr = rand.Read(processSecretVal)
+	})
+	return processSecretVal, processSecretErr
+}
+
+func newAuthenticator(c cfg) (*authenticator, error) {
+	if c.Auth.UsersFile == "" && c.Auth.TokensFile == "" {
+		return nil, nil
+	}
+	a := &authenticator{}
+
+	if c.Auth.TokensFile != "" {
+		toks, err := readCredentialFile(c.Auth.TokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("tokens file: %w", err)
+		}
+		a.providers = append(a.providers, &tokenProvider{tokens: toks})
+	}
+
+	if c.Auth.UsersFile != "" {
+		entries, err := readCredentialFile(c.Auth.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("users file: %w", err)
+		}
+		users := make(map[string][]byte, len(entries))
+		for name, h := range entries {
+			if _, err := bcrypt.Cost([]byte(h)); err != nil {
+				return nil, fmt.Errorf("users file: %s: not a bcrypt hash", name)
+			}
+			users[name] = []byte(h)
+		}
+
+		secret := []byte(c.Auth.SessionSecret)
+		if len(secret) == 0 {
+			if secret, err = processSecret(); err != nil {
+				return nil, err
+			}
+		}
+		a.basic = &basicProvider{users: users}
+		a.sessions = &sessionProvider{secret: secret, ttl: c.Auth.SessionTTL, users: users}
+		a.providers = append(a.providers, a.sessions, a.basic)
+	}
+	return a, nil
+}
+
+func isPublicPath(p string) bool {
+	switch p {
+	case "/healthz", "/login", "/login.html", "/api/login", "/api/logout":
+		return true
+	}
+	return strings.HasPrefix(p, "/assets/")
+}
+
+func (a *authenticator) identify(r *http.Request) *identity {
+	for _, pr := range a.providers {
+		if id := pr.authenticate(r); id != nil {
+			return id
+		}
+	}
+	return nil
+}
+
+func (a *authenticator) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := a.identify(r); id != nil {
+			h.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+			return
+		}
+		if isPublicPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if a.sessions != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="s3-browser"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Next     string `json:"next"`
+}
+
+func safeNext(next string) string {
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+func (a *authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.sessions == nil {
+		http.Error(w, "session login disabled", http.StatusNotFound)
+		return
+	}
+
+	var req loginRequest
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		req = loginRequest{Username: r.PostForm.Get("username"), Password: r.PostForm.Get("password"), Next: r.PostForm.Get("next")}
+	}
+	next := safeNext(req.Next)
+
+	if !a.basic.check(req.Username, req.Password) {
+		if isJSON {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/login?error=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	val, exp := a.sessions.issue(req.Username)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    val,
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(identity{Name: req.Username, Method: "session"})
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (a *authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
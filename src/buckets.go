@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bucketDiscoveryTTL = time.Minute
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Buckets []struct {
+		Name         string    `xml:"Name"`
+		CreationDate time.Time `xml:"CreationDate"`
+	} `xml:"Buckets>Bucket"`
+}
+
+// bucketSet resolves which buckets a proxy may serve: either the static
+// list from configuration or, when discovery is on, the ListBuckets result
+// of the endpoint, cached for bucketDiscoveryTTL.
+type bucketSet struct {
+	static   []string
+	discover bool
+
+	mu      sync.Mutex
+	cached  []string
+	fetched time.Time
+}
+
+func (p *proxy) listBuckets(ctx context.Context) ([]string, error) {
+	u := *p.origin
+	u.Path = "/"
+	u.RawPath = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list buckets failed: %s", resp.Status)
+	}
+	var out listAllMyBucketsResult
+	if err := xml.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(out.Buckets))
+	for _, b := range out.Buckets {
+		names = append(names, b.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (p *proxy) buckets(ctx context.Context) ([]string, error) {
+	bs := p.bucketSet
+	if !bs.discover {
+		return bs.static, nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.cached != nil && time.Since(bs.fetched) < bucketDiscoveryTTL {
+		return bs.cached, nil
+	}
+	names, err := p.listBuckets(ctx)
+	if err != nil {
+		if bs.cached != nil {
+			return bs.cached, nil
+		}
+		return nil, err
+	}
+	bs.cached, bs.fetched = names, time.Now()
+	return names, nil
+}
+
+// requestBucket returns the bucket selected by the "bucket" query parameter,
+// falling back to the default bucket. It writes the error response itself.
+func (p *proxy) requestBucket(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return p.resolveBucket(w, r, r.URL.Query().Get("bucket"))
+}
+
+func (p *proxy) resolveBucket(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = p.cfg.Bucket
+	}
+	if name == "" {
+		http.Error(w, "bucket is required", http.StatusBadRequest)
+		return "", false
+	}
+	names, err := p.buckets(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("buckets: %v", err), http.StatusBadGateway)
+		return "", false
+	}
+	for _, n := range names {
+		if n == name {
+			return name, true
+		}
+	}
+	http.Error(w, fmt.Sprintf("unknown bucket %q", name), http.StatusNotFound)
+	return "", false
+}
+
+type bucketJSON struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default,omitempty"`
+}
+
+type bucketsResponse struct {
+	Default string       `json:"default,omitempty"`
+	Buckets []bucketJSON `json:"buckets"`
+}
+
+func (p *proxy) handleBuckets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names, err := p.buckets(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("buckets: %v", err), http.StatusBadGateway)
+		return
+	}
+	id := identityFrom(r.Context())
+	out := bucketsResponse{Buckets: make([]bucketJSON, 0, len(names))}
+	for _, n := range names {
+		if !p.policy.visible(id, n, "") {
+			continue
+		}
+		if n == p.cfg.Bucket {
+			out.Default = n
+		}
+		out.Buckets = append(out.Buckets, bucketJSON{Name: n, Default: n == p.cfg.Bucket})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const configPollInterval = 2 * time.Second
+
+type profileCfg struct {
+	Endpoint        string   `json:"endpoint" yaml:"endpoint"`
+	Region          string   `json:"region" yaml:"region"`
+	AKID            string   `json:"accessKeyId" yaml:"accessKeyId"`
+	Secret          string   `json:"secretAccessKey" yaml:"secretAccessKey"`
+	Bucket          string   `json:"bucket" yaml:"bucket"`
+	Buckets         []string `json:"buckets" yaml:"buckets"`
+	DiscoverBuckets bool     `json:"discoverBuckets" yaml:"discoverBuckets"`
+	RootPrefix      string   `json:"rootPrefix" yaml:"rootPrefix"`
+}
+
+type authCfg struct {
+	UsersFile     string        `yaml:"usersFile"`
+	TokensFile    string        `yaml:"tokensFile"`
+	SessionSecret string        `yaml:"sessionSecret"`
+	SessionTTL    time.Duration `yaml:"sessionTTL"`
+}
+
+type limitsCfg struct {
+	MaxUploadSize byteSize     `yaml:"maxUploadSize"`
+	Uploads       []uploadRule `yaml:"uploads"`
+}
+
+// trashCfg controls the purge of old trash entries. A nil Retention means
+// the default; zero keeps entries forever.
+type trashCfg struct {
+	Retention     *time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration  `yaml:"purgeInterval"`
+}
+
+func (t trashCfg) retention() time.Duration {
+	if t.Retention == nil {
+		return defaultTrashKeepFor
+	}
+	return *t.Retention
+}
+
+func (t trashCfg) purgeInterval() time.Duration {
+	if t.PurgeInterval <= 0 {
+		return defaultTrashPurge
+	}
+	return t.PurgeInterval
+}
+
+// thumbsCfg says where generated thumbnails are kept: "disk" (under
+// stateDir), "bucket" (under Prefix, next to the images) or "none".
+type thumbsCfg struct {
+	Cache         string   `yaml:"cache"`
+	Prefix        string   `yaml:"prefix"`
+	MaxSourceSize byteSize `yaml:"maxSourceSize"`
+}
+
+const defaultThumbSource = 50 << 20
+
+func (t thumbsCfg) maxSourceSize() int64 {
+	if t.MaxSourceSize <= 0 {
+		return defaultThumbSource
+	}
+	return int64(t.MaxSourceSize)
+}
+
+// uiCfg holds frontend defaults, served to the browser by /api/config.
+type uiCfg struct {
+	TrashPrefix     string   `yaml:"trashPrefix"`
+	RootPrefix      string   `yaml:"rootPrefix"`
+	BucketMaskURL   string   `yaml:"bucketMaskUrl"`
+	ExcludePatterns []string `yaml:"excludePatterns"`
+	Disable         []string `yaml:"disable"`
+}
+
+const (
+	featUpload       = "upload"
+	featDelete       = "delete"
+	featRename       = "rename"
+	featDeletePrefix = "deletePrefix"
+	featDownloadAll  = "downloadAll"
+	featPreview      = "preview"
+	featTrash        = "trash"
+	featThumbnails   = "thumbnails"
+)
+
+var knownFeatures = []string{featUpload, featDelete, featRename, featDeletePrefix, featDownloadAll, featPreview, featTrash, featThumbnails}
+
+// writeFeatures are switched off in read-only mode.
+var writeFeatures = map[string]bool{featUpload: true, featDelete: true, featRename: true, featDeletePrefix: true, featTrash: true}
+
+type cfg struct {
+	Port            string                `yaml:"port"`
+	DefaultProfile  string                `yaml:"default"`
+	Profiles        map[string]profileCfg `yaml:"profiles"`
+	ProfilesFile    string                `yaml:"profilesFile"`
+	PolicyFile      string                `yaml:"policyFile"`
+	ReadOnly        bool                  `yaml:"readOnly"`
+	VerifyChecksums bool                  `yaml:"verifyChecksums"`
+	StateDir        string                `yaml:"stateDir"`
+	Auth            authCfg               `yaml:"auth"`
+	Limits          limitsCfg             `yaml:"limits"`
+	UI              uiCfg                 `yaml:"ui"`
+	Trash           trashCfg              `yaml:"trash"`
+	Thumbs          thumbsCfg             `yaml:"thumbs"`
+
+	path string
+}
+
+// byteSize accepts plain byte counts or values such as "512MiB" / "5GB".
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return byteSize(n * mult), nil
+}
+
+func (b *byteSize) UnmarshalYAML(n *yaml.Node) error {
+	v, err := parseByteSize(n.Value)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *profileCfg) normalize() error {
+	var errs []error
+	for _, f := range []struct{ name, v string }{
+		{"endpoint", c.Endpoint}, {"region", c.Region}, {"accessKeyId", c.AKID}, {"secretAccessKey", c.Secret},
+	} {
+		if f.v == "" {
+			errs = append(errs, fmt.Errorf("%s is required", f.name))
+		}
+	}
+	if c.Bucket == "" && len(c.Buckets) > 0 {
+		c.Bucket = c.Buckets[0]
+	}
+	if c.Bucket == "" && !c.DiscoverBuckets {
+		errs = append(errs, fmt.Errorf("bucket (or buckets / discoverBuckets) is required"))
+	}
+	if c.Bucket != "" && !c.DiscoverBuckets && !containsString(c.Buckets, c.Bucket) {
+		c.Buckets = append([]string{c.Bucket}, c.Buckets...)
+	}
+	if c.RootPrefix != "" {
+		rp, err := cleanKey(c.RootPrefix)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid rootPrefix: %v", err))
+		} else {
+			c.RootPrefix = strings.TrimSuffix(rp, "/") + "/"
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readConfigFile(p string) (cfg, error) {
+	var c cfg
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return c, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader([]byte(os.ExpandEnv(string(b)))))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", p, err)
+	}
+	return c, nil
+}
+
+// applyEnv lets the historical environment variables override the file.
+// S3_* variables apply to the default profile, creating it when needed.
+func (c *cfg) applyEnv() error {
+	str := func(k string, dst *string) {
+		if v := strings.TrimSpace(os.Getenv(k)); v != "" {
+			*dst = v
+		}
+	}
+	str("PORT", &c.Port)
+	str("S3_PROFILES_FILE", &c.ProfilesFile)
+	str("AUTH_USERS_FILE", &c.Auth.UsersFile)
+	str("AUTH_TOKENS_FILE", &c.Auth.TokensFile)
+	str("POLICY_FILE", &c.PolicyFile)
+	str("TRASH_PREFIX", &c.UI.TrashPrefix)
+	str("STATE_DIR", &c.StateDir)
+	str("THUMB_CACHE", &c.Thumbs.Cache)
+	str("THUMB_PREFIX", &c.Thumbs.Prefix)
+	if v := os.Getenv("AUTH_SESSION_SECRET"); v != "" {
+		c.Auth.SessionSecret = v
+	}
+
+	var errs []error
+	if v := strings.TrimSpace(os.Getenv("AUTH_SESSION_TTL")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("AUTH_SESSION_TTL: %v", err))
+		}
+		c.Auth.SessionTTL = d
+	}
+	if v := strings.TrimSpace(os.Getenv("TRASH_RETENTION")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("TRASH_RETENTION: %v", err))
+		}
+		c.Trash.Retention = &d
+	}
+	if v := strings.TrimSpace(os.Getenv("READ_ONLY")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("READ_ONLY: %v", err))
+		}
+		c.ReadOnly = b
+	}
+	if v := strings.TrimSpace(os.Getenv("VERIFY_CHECKSUMS")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("VERIFY_CHECKSUMS: %v", err))
+		}
+		c.VerifyChecksums = b
+	}
+	if v := strings.TrimSpace(os.Getenv("MAX_UPLOAD_SIZE")); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MAX_UPLOAD_SIZE: %v", err))
+		}
+		c.Limits.MaxUploadSize = n
+	}
+
+	if c.ProfilesFile != "" {
+		pf, err := loadProfilesFile(c.ProfilesFile)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			if c.Profiles == nil {
+				c.Profiles = map[string]profileCfg{}
+			}
+			for name, pc := range pf.Profiles {
+				c.Profiles[name] = pc
+			}
+			if c.DefaultProfile == "" {
+				c.DefaultProfile = pf.Default
+			}
+		}
+	}
+
+	def := c.DefaultProfile
+	if def == "" {
+		def = defaultProfileName
+	}
+	pc, exists := c.Profiles[def]
+	touched := false
+	for k, dst := range map[string]*string{
+		"S3_ENDPOINT":          &pc.Endpoint,
+		"S3_REGION":            &pc.Region,
+		"S3_ACCESS_KEY_ID":     &pc.AKID,
+		"S3_SECRET_ACCESS_KEY": &pc.Secret,
+		"S3_BUCKET":            &pc.Bucket,
+		"S3_ROOT_PREFIX":       &pc.RootPrefix,
+	} {
+		if v := strings.TrimSpace(os.Getenv(k)); v != "" {
+			*dst, touched = v, true
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("S3_BUCKETS")); v == "*" {
+		pc.DiscoverBuckets, pc.Buckets, touched = true, nil, true
+	} else if v != "" {
+		pc.Buckets, touched = nil, true
+		for _, b := range strings.Split(v, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				pc.Buckets = append(pc.Buckets, b)
+			}
+		}
+	}
+	if touched || exists {
+		if c.Profiles == nil {
+			c.Profiles = map[string]profileCfg{}
+		}
+		c.Profiles[def] = pc
+		c.DefaultProfile = def
+	}
+	return errors.Join(errs...)
+}
+
+func (c *cfg) validate() error {
+	var errs []error
+	if c.Port == "" {
+		c.Port = "8080"
+	}
+	if n, err := strconv.Atoi(c.Port); err != nil || n <= 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("port: invalid value %q", c.Port))
+	}
+	if len(c.Profiles) == 0 {
+		errs = append(errs, fmt.Errorf("no S3 profile configured: set S3_ENDPOINT & co or add profiles to the config file"))
+	}
+	if c.DefaultProfile == "" && len(c.Profiles) == 1 {
+		for name := range c.Profiles {
+			c.DefaultProfile = name
+		}
+	}
+	if _, ok := c.Profiles[c.DefaultProfile]; !ok && len(c.Profiles) > 0 {
+		errs = append(errs, fmt.Errorf("default: profile %q is not defined", c.DefaultProfile))
+	}
+	for name, pc := range c.Profiles {
+		if !profileNameRe.MatchString(name) {
+			errs = append(errs, fmt.Errorf("profiles: invalid name %q", name))
+		}
+		if err := pc.normalize(); err != nil {
+			errs = append(errs, prefixErrors("profiles."+name, err))
+		}
+		c.Profiles[name] = pc
+	}
+	if c.Auth.SessionTTL == 0 {
+		c.Auth.SessionTTL = 12 * time.Hour
+	}
+	if c.Auth.SessionTTL < 0 {
+		errs = append(errs, fmt.Errorf("auth.sessionTTL: must be positive"))
+	}
+	if c.UI.TrashPrefix == "" {
+		c.UI.TrashPrefix = "_trash/"
+	}
+	if tp, err := cleanKey(c.UI.TrashPrefix); err != nil || tp == "" {
+		errs = append(errs, fmt.Errorf("ui.trashPrefix: invalid value %q", c.UI.TrashPrefix))
+	} else {
+		c.UI.TrashPrefix = strings.TrimSuffix(tp, "/") + "/"
+	}
+	if c.UI.RootPrefix != "" {
+		if rp, err := cleanKey(c.UI.RootPrefix); err != nil {
+			errs = append(errs, fmt.Errorf("ui.rootPrefix: invalid value %q", c.UI.RootPrefix))
+		} else {
+			c.UI.RootPrefix = strings.TrimSuffix(rp, "/") + "/"
+		}
+	}
+	if c.UI.ExcludePatterns == nil {
+		c.UI.ExcludePatterns = []string{`^index\.html$`}
+	}
+	for i, pat := range c.UI.ExcludePatterns {
+		if _, err := regexp.Compile(pat); err != nil {
+			errs = append(errs, fmt.Errorf("ui.excludePatterns[%d]: %v", i, err))
+		}
+	}
+	if c.StateDir == "" {
+		c.StateDir = filepath.Join(os.TempDir(), "s3-browser")
+	}
+	for i := range c.Limits.Uploads {
+		if err := c.Limits.Uploads[i].normalize(); err != nil {
+			errs = append(errs, prefixErrors(fmt.Sprintf("limits.uploads[%d]", i), err))
+		}
+	}
+	switch c.Thumbs.Cache {
+	case "":
+		c.Thumbs.Cache = thumbCacheDisk
+	case thumbCacheDisk, thumbCacheBucket, thumbCacheNone:
+	default:
+		errs = append(errs, fmt.Errorf("thumbs.cache: unknown value %q (known: disk, bucket, none)", c.Thumbs.Cache))
+	}
+	if c.Thumbs.Prefix == "" {
+		c.Thumbs.Prefix = ".thumbs/"
+	}
+	if tp, err := cleanKey(c.Thumbs.Prefix); err != nil || tp == "" {
+		errs = append(errs, fmt.Errorf("thumbs.prefix: invalid value %q", c.Thumbs.Prefix))
+	} else {
+		c.Thumbs.Prefix = strings.TrimSuffix(tp, "/") + "/"
+	}
+	if c.Trash.retention() < 0 {
+		errs = append(errs, fmt.Errorf("trash.retention: must not be negative"))
+	}
+	for _, f := range c.UI.Disable {
+		if !containsString(knownFeatures, f) {
+			errs = append(errs, fmt.Errorf("ui.disable: unknown feature %q (known: %s)", f, strings.Join(knownFeatures, ", ")))
+		}
+	}
+	for _, f := range []struct{ name, path string }{
+		{"profilesFile", c.ProfilesFile}, {"policyFile", c.PolicyFile},
+		{"auth.usersFile", c.Auth.UsersFile}, {"auth.tokensFile", c.Auth.TokensFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", f.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func prefixErrors(prefix string, err error) error {
+	var out []error
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range j.Unwrap() {
+			out = append(out, fmt.Errorf("%s: %w", prefix, e))
+		}
+		return errors.Join(out...)
+	}
+	return fmt.Errorf("%s: %w", prefix, err)
+}
+
+// loadCfg reads the optional YAML file at path, applies environment
+// overrides and validates the result. All problems are reported at once.
+func loadCfg(path string) (cfg, error) {
+	var c cfg
+	if path != "" {
+		var err error
+		if c, err = readConfigFile(path); err != nil {
+			return c, err
+		}
+	}
+	c.path = path
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// watchedFiles lists every file whose content feeds the configuration.
+func (c cfg) watchedFiles() []string {
+	var out []string
+	for _, p := range []string{c.path, c.ProfilesFile, c.PolicyFile, c.Auth.UsersFile, c.Auth.TokensFile} {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func fileStamps(paths []string) map[string]time.Time {
+	out := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		if st, err := os.Stat(p); err == nil {
+			out[p] = st.ModTime()
+		}
+	}
+	return out
+}
+
+func (s *server) reload() {
+	c, err := loadCfg(s.path)
+	if err != nil {
+		log.Printf("config reload failed, keeping previous configuration:\n%v", err)
+		return
+	}
+	reg, err := newRegistry(c)
+	if err != nil {
+		log.Printf("config reload failed, keeping previous configuration: %v", err)
+		return
+	}
+	old := s.current.Swap(reg)
+	if old != nil && old.cfg.Port != c.Port {
+		log.Printf("config reload: port change to %s needs a restart", c.Port)
+	}
+	log.Printf("config reloaded (profiles=%d, default=%s)", len(reg.names), reg.def)
+}
+
+// watch reloads the configuration on SIGHUP and whenever one of the
+// configuration files changes on disk.
+func (s *server) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(configPollInterval)
+	defer tick.Stop()
+
+	stamps := fileStamps(s.current.Load().cfg.watchedFiles())
+	for {
+		select {
+		case <-hup:
+			log.Printf("SIGHUP received, reloading configuration")
+			s.reload()
+		case <-tick.C:
+			now := fileStamps(s.current.Load().cfg.watchedFiles())
+			changed := len(now) != len(stamps)
+			for p, t := range now {
+				if !stamps[p].Equal(t) {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			log.Printf("configuration files changed, reloading")
+			s.reload()
+		}
+		stamps = fileStamps(s.current.Load().cfg.watchedFiles())
+	}
+}
+
+// features reports which UI features are enabled for this deployment.
+func (c cfg) features() map[string]bool {
+	out := make(map[string]bool, len(knownFeatures))
+	for _, f := range knownFeatures {
+		out[f] = !containsString(c.UI.Disable, f) && !(c.ReadOnly && writeFeatures[f])
+	}
+	return out
+}
+
+type configResponse struct {
+	Profile         string          `json:"profile"`
+	Bucket          string          `json:"bucket"`
+	RootPrefix      string          `json:"rootPrefix"`
+	TrashPrefix     string          `json:"trashPrefix"`
+	ThumbPrefix     string          `json:"thumbPrefix,omitempty"`
+	BucketURL       string          `json:"bucketUrl"`
+	BucketMaskURL   string          `json:"bucketMaskUrl"`
+	ExcludePatterns []string        `json:"excludePatterns"`
+	ReadOnly        bool            `json:"readOnly"`
+	MaxUploadSize   int64           `json:"maxUploadSize,omitempty"`
+	Features        map[string]bool `json:"features"`
+}
+
+func (p *proxy) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mask := p.global.UI.BucketMaskURL
+	if mask == "" {
+		mask = "/s3"
+	}
+	out := configResponse{
+		Profile:         p.name,
+		Bucket:          p.cfg.Bucket,
+		RootPrefix:      p.global.UI.RootPrefix,
+		TrashPrefix:     p.global.UI.TrashPrefix,
+		BucketURL:       "/s3",
+		BucketMaskURL:   mask,
+		ExcludePatterns: p.global.UI.ExcludePatterns,
+		ReadOnly:        p.global.ReadOnly,
+		MaxUploadSize:   int64(p.global.Limits.MaxUploadSize),
+		Features:        p.global.features(),
+	}
+	if p.global.Thumbs.Cache == thumbCacheBucket {
+		out.ThumbPrefix = p.global.Thumbs.Prefix
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{" 1024 ", 1024, false},
+		{"1KiB", 1 << 10, false},
+		{"512MiB", 512 << 20, false},
+		{"5GiB", 5 << 30, false},
+		{"2 TiB", 2 << 40, false},
+		{"5GB", 5e9, false},
+		{"1K", 1 << 10, false},
+		{"10B", 10, false},
+		{"8388607T", 8388607 << 40, false},
+		{"8388608T", 0, true},
+		{"9000000T", 0, true},
+		{"9223372036854775807", 9223372036854775807, false},
+		{"9223372036854775808", 0, true},
+		{"-1", 0, true},
+		{"", 0, true},
+		{"1.5GiB", 0, true},
+		{"GiB", 0, true},
+		{"12XB", 0, true},
+	} {
+		got, err := parseByteSize(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
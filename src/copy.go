@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type copyResponse struct {
+	Status    string     `json:"status"`
+	Copied    int        `json:"copied"`
+	Succeeded []string   `json:"succeeded"`
+	Failed    []keyError `json:"failed"`
+	Took      int64      `json:"tookMs"`
+}
+
+// copyPrefix duplicates every object under src to dst server-side.
+func (p *proxy) copyPrefix(ctx context.Context, bucket, src, dst string, workers int) (copyResponse, error) {
+	start := time.Now()
+	rels, sizes, err := p.pendingRels(ctx, bucket, src)
+	if err != nil {
+		return copyResponse{}, fmt.Errorf("list: %w", err)
+	}
+	rels, refused := p.checkDestinations(ctx, bucket, src, dst, rels, sizes)
+	copied, failed := p.eachKey(ctx, src, dst, rels, sizes, renameConcurrency(workers), func(s, d string) error {
+		return withRetry(ctx, func() error { return p.copyObject(ctx, bucket, s, d) })
+	})
+	out := copyResponse{Status: renameStatusDone, Copied: len(copied), Succeeded: make([]string, len(copied)), Failed: append(refused, failed...), Took: time.Since(start).Milliseconds()}
+	for i, rel := range copied {
+		out.Succeeded[i] = src + rel
+	}
+	if out.Failed == nil {
+		out.Failed = []keyError{}
+	} else {
+		out.Status = renameStatusPartly
+	}
+	return out, nil
+}
+
+// handleCopy duplicates a key or, with isPrefix, a folder without moving the
+// bytes through the client. It takes the same body as /api/rename.
+func (p *proxy) handleCopy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	var req renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, req.Bucket)
+	if !ok {
+		return
+	}
+	var err error
+	if req.Src, err = cleanKey(req.Src); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Dst, err = cleanKey(req.Dst); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	src, dst := strings.TrimLeft(req.Src, "/"), strings.TrimLeft(req.Dst, "/")
+	if req.IsPrefix {
+		if src != "" && !strings.HasSuffix(src, "/") {
+			src += "/"
+		}
+		if dst != "" && !strings.HasSuffix(dst, "/") {
+			dst += "/"
+		}
+		if err := checkPrefixPair(src, dst); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if src == "" || dst == "" {
+		http.Error(w, "src and dst are required", http.StatusBadRequest)
+		return
+	}
+	if src == dst {
+		http.Error(w, "src and dst are the same", http.StatusBadRequest)
+		return
+	}
+	if !p.authorize(w, r, actRead, bucket, src) || !p.authorize(w, r, actWrite, bucket, dst) {
+		return
+	}
+	if !req.IsPrefix {
+		if e := checkKey(p.uploadRule(bucket, dst), dst); e != nil {
+			e.write(w)
+			return
+		}
+	}
+
+	if req.IsPrefix {
+		run := func(ctx context.Context) (any, error) { return p.copyPrefix(ctx, bucket, src, dst, req.Concurrency) }
+		switch {
+		case wantsAsync(r, req.Async):
+			p.startJob(w, r, "copy", bucket, map[string]string{"src": src, "dst": dst}, run)
+			return
+		case streamMode(r) != "":
+			p.stream(w, r, run)
+			return
+		}
+		out, err := p.copyPrefix(ctx, bucket, src, dst, req.Concurrency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	start := time.Now()
+	if err := withRetry(ctx, func() error { return p.copyObject(ctx, bucket, src, dst) }); errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("%s not found", src), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("copy %s -> %s: %v", src, dst, err), http.StatusBadGateway)
+		return
+	}
+	out := copyResponse{Status: renameStatusDone, Copied: 1, Succeeded: []string{src}, Failed: []keyError{}, Took: time.Since(start).Milliseconds()}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	deleteBatchSize     = 1000
+	singleDeleteWorkers = 16
+)
+
+type keyError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type deleteObjectsRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteObjectsResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Errors  []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// errMultiDeleteUnsupported marks backends without the DeleteObjects API.
+type errMultiDeleteUnsupported struct{ status string }
+
+func (e errMultiDeleteUnsupported) Error() string {
+	return "multi-object delete not supported: " + e.status
+}
+
+// deleteBatch removes up to deleteBatchSize keys with one DeleteObjects call
+// and returns the keys S3 reported as failed.
+func (p *proxy) deleteBatch(ctx context.Context, bucket string, keys []string) ([]keyError, error) {
+	body := deleteObjectsRequest{Quiet: true}
+	for _, k := range keys {
+		body.Objects = append(body.Objects, struct {
+			Key string `xml:"Key"`
+		}{Key: p.rootKey(srcToPath(k))})
+	}
+	b, err := xml.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(b)
+
+	u := *p.origin
+	u.Path = "/" + bucket
+	u.RawPath = "/" + url.PathEscape(bucket)
+	u.RawQuery = "delete="
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(b))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return nil, errMultiDeleteUnsupported{resp.Status}
+	default:
+		if bytes.Contains(rb, []byte("<Code>NotImplemented</Code>")) {
+			return nil, errMultiDeleteUnsupported{resp.Status}
+		}
+		return nil, fmt.Errorf("delete objects failed: %s", resp.Status)
+	}
+
+	var res deleteObjectsResult
+	if err := xml.Unmarshal(rb, &res); err != nil {
+		return nil, err
+	}
+	var failed []keyError
+	for _, e := range res.Errors {
+		msg := e.Code
+		if e.Message != "" {
+			msg += ": " + e.Message
+		}
+		failed = append(failed, keyError{Key: p.relKey(e.Key), Error: msg})
+	}
+	return failed, nil
+}
+
+// deleteSingles deletes keys one by one with a bounded pool of workers.
+func (p *proxy) deleteSingles(ctx context.Context, bucket string, keys []string) []keyError {
+	var (
+		mu     sync.Mutex
+		failed []keyError
+		wg     sync.WaitGroup
+	)
+	ch := make(chan string)
+	for i := 0; i < singleDeleteWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range ch {
+				if err := p.deleteObject(ctx, bucket, k); err != nil {
+					mu.Lock()
+					failed = append(failed, keyError{Key: k, Error: err.Error()})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, k := range keys {
+		ch <- k
+	}
+	close(ch)
+	wg.Wait()
+	return failed
+}
+
+// deleteKeys removes keys in DeleteObjects batches, falling back to parallel
+// single deletes when the backend does not implement the multi-object API.
+// It never stops at the first failure: every failed key is returned.
+func (p *proxy) deleteKeys(ctx context.Context, bucket string, keys []string) (int, []keyError) {
+	var failed []keyError
+	deleted := 0
+	pr := progressFrom(ctx)
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := min(start+deleteBatchSize, len(keys))
+		batch := keys[start:end]
+
+		var errs []keyError
+		if ctx.Err() != nil {
+			for _, k := range keys[start:] {
+				failed = append(failed, keyError{Key: k, Error: ctx.Err().Error()})
+			}
+			break
+		}
+		if p.noMultiDelete.Load() {
+			errs = p.deleteSingles(ctx, bucket, batch)
+		} else {
+			var err error
+			errs, err = p.deleteBatch(ctx, bucket, batch)
+			if _, ok := err.(errMultiDeleteUnsupported); ok {
+				p.noMultiDelete.Store(true)
+				errs = p.deleteSingles(ctx, bucket, batch)
+			} else if err != nil {
+				errs = make([]keyError, 0, len(batch))
+				for _, k := range batch {
+					errs = append(errs, keyError{Key: k, Error: err.Error()})
+				}
+			}
+		}
+		deleted += len(batch) - len(errs)
+		failed = append(failed, errs...)
+		reportBatch(pr, batch, errs)
+	}
+	return deleted, failed
+}
+
+func reportBatch(pr progress, batch []string, errs []keyError) {
+	bad := make(map[string]string, len(errs))
+	for _, e := range errs {
+		bad[e.Key] = e.Error
+	}
+	for _, k := range batch {
+		if msg, ok := bad[k]; ok {
+			pr.step(k, 0, errors.New(msg))
+		} else {
+			pr.step(k, 0, nil)
+		}
+	}
+}
+
+// deletePrefix removes every object under pfx, leaving the bucket cache of
+// thumbnails alone unless pfx is inside it.
+func (p *proxy) deletePrefix(ctx context.Context, bucket, pfx string) (deletePrefixResponse, error) {
+	start := time.Now()
+	all, err := p.listAllKeys(ctx, bucket, pfx)
+	if err != nil {
+		return deletePrefixResponse{}, fmt.Errorf("list: %w", err)
+	}
+	keys := all[:0]
+	for _, k := range all {
+		if !p.skipThumb(pfx, k) {
+			keys = append(keys, k)
+		}
+	}
+	progressFrom(ctx).addTotal(len(keys), 0)
+	deleted, failed := p.deleteKeys(ctx, bucket, keys)
+	return deletePrefixResponse{Deleted: deleted, Failed: len(failed), Errors: failed, Took: time.Since(start).Milliseconds()}, nil
+}
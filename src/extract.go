@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Entries up to extractBufferSize are read into memory and uploaded by
+	// the workers while the archive is read on; larger ones are streamed
+	// to S3 one at a time.
+	extractBufferSize = 1 << 20
+	maxExtractEntries = 100000
+
+	extractSkip      = "skip"
+	extractOverwrite = "overwrite"
+	extractFail      = "fail"
+
+	entryExtracted = "extracted"
+	entrySkipped   = "skipped"
+	entryFailed    = "failed"
+)
+
+type extractRequest struct {
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+	Dst    string `json:"dst"`
+	// Overwrite says what to do when a target key exists: skip the entry
+	// (default), overwrite the object, or fail the entry.
+	Overwrite   string `json:"overwrite,omitempty"`
+	Concurrency int    `json:"concurrency,omitempty"`
+}
+
+type extractEntry struct {
+	seq    int
+	Entry  string `json:"entry"`
+	Key    string `json:"key,omitempty"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type extractResponse struct {
+	Status    string         `json:"status"`
+	Format    string         `json:"format"`
+	Extracted int            `json:"extracted"`
+	Skipped   int            `json:"skipped"`
+	Failed    int            `json:"failed"`
+	Entries   []extractEntry `json:"entries"`
+	Took      int64          `json:"tookMs"`
+}
+
+// extractKey maps an entry name to a key under dst. Absolute names, drive
+// letters and ".." segments are refused rather than cleaned, so that no
+// entry can land outside dst.
+func extractKey(dst, name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("unsafe entry name %q", name)
+	}
+	var segs []string
+	for _, seg := range strings.Split(name, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			return "", fmt.Errorf("unsafe entry name %q", name)
+		default:
+			segs = append(segs, seg)
+		}
+	}
+	if len(segs) == 0 {
+		return "", fmt.Errorf("empty entry name")
+	}
+	return dst + strings.Join(segs, "/"), nil
+}
+
+// walk calls fn with every entry of the archive, in order. open is nil for
+// folders, links and other entries that are not regular files; the reader
+// it returns is only valid until fn returns.
+func (a *storedArchive) walk(fn func(e archiveEntry, open func() (io.ReadCloser, error)) error) error {
+	if a.zr != nil {
+		for _, f := range a.zr.File {
+			e := archiveEntry{Name: f.Name, Size: int64(f.UncompressedSize64), Modified: f.Modified.UTC(), Dir: f.FileInfo().IsDir()}
+			var open func() (io.ReadCloser, error)
+			if f.Mode().IsRegular() {
+				open = f.Open
+			}
+			if err := fn(e, open); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		hdr, err := a.tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := archiveEntry{Name: hdr.Name, Size: hdr.Size, Modified: hdr.ModTime.UTC(), Dir: hdr.Typeflag == tar.TypeDir}
+		var open func() (io.ReadCloser, error)
+		if hdr.FileInfo().Mode().Type() == 0 {
+			open = func() (io.ReadCloser, error) { return io.NopCloser(a.tr), nil }
+		}
+		if err := fn(e, open); err != nil {
+			return err
+		}
+	}
+}
+
+// exactReader yields the n bytes of r and fails on the last read when r is
+// shorter or longer, so that an entry whose header lies about its size fails
+// the upload instead of being stored truncated.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(b []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > e.n {
+		b = b[:e.n]
+	}
+	n, err := e.r.Read(b)
+	e.n -= int64(n)
+	if e.n > 0 {
+		if err == io.EOF {
+			return n, fmt.Errorf("entry is %d bytes shorter than its header says", e.n)
+		}
+		return n, err
+	}
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	var probe [1]byte
+	switch m, err := io.ReadFull(e.r, probe[:]); {
+	case m > 0:
+		return n, errors.New("entry is longer than its header says")
+	case err != io.EOF:
+		return n, err
+	}
+	return n, nil
+}
+
+// putObjectStream uploads size bytes of body to key, as a multipart upload
+// when it is over the single PUT limit. Nothing is retried: the body is read
+// once.
+func (p *proxy) putObjectStream(ctx context.Context, bucket, key, contentType string, body io.Reader, size int64) error {
+	if size <= maxPartSize {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPut, p.objectURL(bucket, key), io.LimitReader(body, size))
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+		resp, err := p.signAndDo(ctx, req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("put failed: %s", resp.Status)
+		}
+		return nil
+	}
+	id, err := p.createMultipart(ctx, bucket, key, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	partSize := partSizeFor(size, uploadPartSize)
+	var parts []completedPart
+	for n, off := 1, int64(0); off < size && err == nil; n, off = n+1, off+partSize {
+		var etag string
+		ps := min(partSize, size-off)
+		if etag, err = p.uploadPart(ctx, bucket, key, id, n, io.LimitReader(body, ps), ps, ""); err == nil {
+			parts = append(parts, completedPart{PartNumber: n, ETag: etag})
+		}
+	}
+	if err == nil {
+		_, err = p.completeMultipart(ctx, bucket, key, id, parts)
+	}
+	if err != nil {
+		if aerr := p.abortMultipart(context.WithoutCancel(ctx), bucket, key, id); aerr != nil {
+			return fmt.Errorf("%w (abort: %v)", err, aerr)
+		}
+	}
+	return err
+}
+
+// extractArchive writes every file of the archive at key as an object under
+// dst. Failures are reported per entry and do not stop the extraction.
+func (p *proxy) extractArchive(ctx context.Context, bucket, key, dst, overwrite string, workers int) (extractResponse, error) {
+	start := time.Now()
+	pr := progressFrom(ctx)
+	a, err := p.openArchive(ctx, bucket, key)
+	if err != nil {
+		return extractResponse{}, err
+	}
+	defer a.Close()
+	if a.zr != nil {
+		var n int
+		var total int64
+		for _, f := range a.zr.File {
+			if !f.FileInfo().IsDir() {
+				n, total = n+1, total+int64(f.UncompressedSize64)
+			}
+		}
+		pr.addTotal(n, total)
+	}
+
+	var (
+		mu      sync.Mutex
+		entries []extractEntry
+		wg      sync.WaitGroup
+	)
+	report := func(e extractEntry, err error) {
+		if err != nil {
+			e.Status, e.Error = entryFailed, err.Error()
+		}
+		pr.step(e.Entry, e.Size, err)
+		mu.Lock()
+		entries = append(entries, e)
+		mu.Unlock()
+	}
+	// prepare checks what can be known before reading the entry: the
+	// target key, the upload rules and the overwrite policy.
+	prepare := func(e *extractEntry) error {
+		k, err := extractKey(dst, e.Entry)
+		if err != nil {
+			return err
+		}
+		e.Key = k
+		if ue := p.checkUpload(bucket, k, e.Size, ""); ue != nil {
+			return ue
+		}
+		if overwrite == extractOverwrite {
+			return nil
+		}
+		exists, err := p.objectExists(ctx, bucket, k)
+		if err != nil {
+			return err
+		}
+		if exists && overwrite == extractFail {
+			return fmt.Errorf("%s already exists", k)
+		}
+		if exists {
+			e.Status = entrySkipped
+		}
+		return nil
+	}
+	// put uploads data, which can be retried, or else streams body.
+	put := func(e extractEntry, body io.Reader, data []byte) error {
+		ct := mime.TypeByExtension(path.Ext(e.Key))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		if data != nil {
+			body = bytes.NewReader(data)
+		}
+		body, ue := p.sniffBody(bucket, e.Key, ct, body)
+		if ue != nil {
+			return ue
+		}
+		if data != nil {
+			return withRetry(ctx, func() error { return p.putObjectBytes(ctx, bucket, e.Key, ct, data) })
+		}
+		return p.putObjectStream(ctx, bucket, e.Key, ct, &exactReader{r: body, n: e.Size}, e.Size)
+	}
+
+	type smallEntry struct {
+		e    extractEntry
+		data []byte
+	}
+	small := make(chan smallEntry, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range small {
+				report(s.e, put(s.e, nil, s.data))
+			}
+		}()
+	}
+
+	seq := 0
+	walkErr := a.walk(func(ae archiveEntry, open func() (io.ReadCloser, error)) error {
+		if ae.Dir {
+			return nil
+		}
+		seq++
+		e := extractEntry{seq: seq, Entry: ae.Name, Size: ae.Size, Status: entryExtracted}
+		if seq > maxExtractEntries {
+			return fmt.Errorf("more than %d entries", maxExtractEntries)
+		}
+		if open == nil {
+			e.Status, e.Error = entrySkipped, "not a regular file"
+			report(e, nil)
+			return nil
+		}
+		if err := prepare(&e); err != nil || e.Status == entrySkipped {
+			report(e, err)
+			return ctx.Err()
+		}
+		rc, err := open()
+		if err != nil {
+			report(e, err)
+			return ctx.Err()
+		}
+		defer rc.Close()
+		if e.Size > extractBufferSize {
+			report(e, put(e, rc, nil))
+			return ctx.Err()
+		}
+		b, err := io.ReadAll(io.LimitReader(rc, extractBufferSize+1))
+		if err == nil && int64(len(b)) != e.Size {
+			err = fmt.Errorf("read %d bytes, expected %d", len(b), e.Size)
+		}
+		if err != nil {
+			report(e, err)
+			return ctx.Err()
+		}
+		select {
+		case small <- smallEntry{e, b}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(small)
+	wg.Wait()
+
+	out := extractResponse{Status: renameStatusDone, Format: a.format, Entries: entries, Took: time.Since(start).Milliseconds()}
+	if out.Entries == nil {
+		out.Entries = []extractEntry{}
+	}
+	sort.Slice(out.Entries, func(i, j int) bool { return out.Entries[i].seq < out.Entries[j].seq })
+	for _, e := range out.Entries {
+		switch e.Status {
+		case entryExtracted:
+			out.Extracted++
+		case entrySkipped:
+			out.Skipped++
+		case entryFailed:
+			out.Failed++
+		}
+	}
+	if walkErr != nil {
+		if seq == 0 && !errors.Is(walkErr, context.Canceled) {
+			return out, fmt.Errorf("%w: %v", errNotArchive, walkErr)
+		}
+		out.Failed++
+		out.Entries = append(out.Entries, extractEntry{Status: entryFailed, Error: fmt.Sprintf("archive: %v", walkErr)})
+	}
+	if out.Failed > 0 {
+		out.Status = renameStatusPartly
+	}
+	return out, nil
+}
+
+// handleExtract unpacks a ZIP or tar object of the bucket under a prefix.
+// It runs as a background job, or streams its progress with ?stream=.
+func (p *proxy) handleExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req extractRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, req.Bucket)
+	if !ok {
+		return
+	}
+	key, err := cleanKey(req.Key)
+	if key = strings.TrimLeft(key, "/"); err != nil || key == "" {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	dst, err := cleanKey(req.Dst)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dst = strings.TrimLeft(dst, "/"); dst != "" && !strings.HasSuffix(dst, "/") {
+		dst += "/"
+	}
+	switch req.Overwrite {
+	case "":
+		req.Overwrite = extractSkip
+	case extractSkip, extractOverwrite, extractFail:
+	default:
+		http.Error(w, fmt.Sprintf("overwrite must be %s, %s or %s", extractSkip, extractOverwrite, extractFail), http.StatusBadRequest)
+		return
+	}
+	if !p.authorize(w, r, actRead, bucket, key) || !p.authorize(w, r, actWrite, bucket, dst) {
+		return
+	}
+
+	run := func(ctx context.Context) (any, error) {
+		return p.extractArchive(ctx, bucket, key, dst, req.Overwrite, renameConcurrency(req.Concurrency))
+	}
+	if streamMode(r) != "" {
+		p.stream(w, r, run)
+		return
+	}
+	p.startJob(w, r, "extract", bucket, map[string]string{"key": key, "dst": dst, "overwrite": req.Overwrite}, run)
+}
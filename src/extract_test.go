@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestExtractKey(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+		ok         bool
+	}{
+		{"a.txt", "out/a.txt", true},
+		{"dir/a.txt", "out/dir/a.txt", true},
+		{"./dir//a.txt", "out/dir/a.txt", true},
+		{`dir\a.txt`, "out/dir/a.txt", true},
+		{"dir/./a.txt", "out/dir/a.txt", true},
+		{"../a.txt", "", false},
+		{"dir/../../a.txt", "", false},
+		{"dir/../a.txt", "", false},
+		{`..\a.txt`, "", false},
+		{"/etc/passwd", "", false},
+		{`\etc\passwd`, "", false},
+		{"C:/a.txt", "", false},
+		{`C:\a.txt`, "", false},
+		{"a\x00.txt", "", false},
+		{"", "", false},
+		{"./", "", false},
+		{"..", "", false},
+		{"a..b/c", "out/a..b/c", true},
+	} {
+		got, err := extractKey("out/", tc.name)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("extractKey(%q) = %q, %v; want %q, ok %v", tc.name, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestExactReader(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		n    int64
+		ok   bool
+	}{
+		{"hello", 5, true},
+		{"hello", 4, false},
+		{"hello", 6, false},
+		{"", 0, true},
+	} {
+		b, err := io.ReadAll(&exactReader{r: strings.NewReader(tc.body), n: tc.n})
+		if (err == nil) != tc.ok {
+			t.Errorf("exactReader(%q, %d) = %q, %v; want ok %v", tc.body, tc.n, b, err, tc.ok)
+		}
+		if err == nil && string(b) != tc.body {
+			t.Errorf("exactReader(%q, %d) = %q", tc.body, tc.n, b)
+		}
+	}
+}
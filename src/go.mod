@@ -2,5 +2,12 @@ module s3-browser
 
 go 1.22
 
-require github.com/aws/aws-sdk-go-v2 v1.30.0
+require (
+	github.com/aws/aws-sdk-go-v2 v1.30.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/image v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require github.com/aws/smithy-go v1.20.2 // indirect
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// digestReader computes the MD5 (and optionally SHA-256) of what is read
+// through it, so that checksums come for free while a body is streamed.
+type digestReader struct {
+	r   io.Reader
+	md5 hash.Hash
+	sha hash.Hash
+}
+
+func newDigestReader(r io.Reader, withSHA bool) *digestReader {
+	d := &digestReader{r: r, md5: md5.New()}
+	if withSHA {
+		d.sha = sha256.New()
+	}
+	return d
+}
+
+func (d *digestReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	d.md5.Write(b[:n])
+	if d.sha != nil {
+		d.sha.Write(b[:n])
+	}
+	return n, err
+}
+
+func (d *digestReader) md5Hex() string { return hex.EncodeToString(d.md5.Sum(nil)) }
+
+// checksums holds the base64 digests announced by a client with the
+// Content-MD5 and x-amz-checksum-sha256 headers.
+type checksums struct {
+	MD5    string
+	SHA256 string
+}
+
+func checksumsFrom(h http.Header) (checksums, error) {
+	c := checksums{MD5: h.Get("Content-MD5"), SHA256: h.Get("X-Amz-Checksum-Sha256")}
+	for _, s := range []struct {
+		name, v string
+		size    int
+	}{{"Content-MD5", c.MD5, md5.Size}, {"x-amz-checksum-sha256", c.SHA256, sha256.Size}} {
+		if s.v == "" {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(s.v); err != nil || len(b) != s.size {
+			return c, fmt.Errorf("invalid %s header", s.name)
+		}
+	}
+	return c, nil
+}
+
+func (c checksums) any() bool { return c.MD5 != "" || c.SHA256 != "" }
+
+// set forwards the client checksums so that S3 verifies them too.
+func (c checksums) set(h http.Header) {
+	if c.MD5 != "" {
+		h.Set("Content-MD5", c.MD5)
+	}
+	if c.SHA256 != "" {
+		h.Set("X-Amz-Checksum-Sha256", c.SHA256)
+	}
+}
+
+// check compares the announced checksums with what went through d.
+func (c checksums) check(d *digestReader) error {
+	if c.MD5 != "" && base64.StdEncoding.EncodeToString(d.md5.Sum(nil)) != c.MD5 {
+		return fmt.Errorf("%w: body does not match Content-MD5", errChecksumMismatch)
+	}
+	if c.SHA256 != "" && d.sha != nil && base64.StdEncoding.EncodeToString(d.sha.Sum(nil)) != c.SHA256 {
+		return fmt.Errorf("%w: body does not match x-amz-checksum-sha256", errChecksumMismatch)
+	}
+	return nil
+}
+
+// plainETag returns the MD5 held by an ETag, or "" for ETags that are not a
+// digest of the content (multipart uploads). SSE-KMS and SSE-C ETags look
+// like an MD5 but are not one: see etagIsDigest.
+func plainETag(etag string) string {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if len(etag) != 2*md5.Size {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+	return etag
+}
+
+// etagIsDigest reports whether the ETag of a response with headers h can be
+// the MD5 of the content, which is not the case for objects encrypted with
+// SSE-KMS or SSE-C.
+func etagIsDigest(h http.Header) bool {
+	switch strings.ToLower(h.Get("X-Amz-Server-Side-Encryption")) {
+	case "aws:kms", "aws:kms:dsse":
+		return false
+	}
+	return h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == ""
+}
+
+// checkETag reports a mismatch between the MD5 the proxy computed and the
+// ETag of a backend response with headers h, when that ETag is a plain MD5.
+func checkETag(h http.Header, md5Hex string) error {
+	if !etagIsDigest(h) {
+		return nil
+	}
+	if e := plainETag(h.Get("ETag")); e != "" && e != md5Hex {
+		return fmt.Errorf("%w: stored ETag %s, sent %s", errChecksumMismatch, e, md5Hex)
+	}
+	return nil
+}
+
+// sectionMD5 returns the base64 MD5 of size bytes of r, for Content-MD5.
+func sectionMD5(r io.ReaderAt, size int64) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// putChecked forwards a PUT with checksums, so that the backend refuses a
+// body that does not match them before anything is stored. With
+// verifyChecksums and no client Content-MD5, the body is spilled to a
+// temporary file first to compute one. The ETag returned is checked too; a
+// mismatch found after the PUT is reported, but the object is left alone,
+// since it already replaced the previous version.
+func (p *proxy) putChecked(w http.ResponseWriter, r *http.Request, pathUnescaped, rawPath string, body io.Reader, cl int64, ct string, sums checksums) {
+	ctx := r.Context()
+	if p.global.VerifyChecksums && sums.MD5 == "" {
+		ra, ok := body.(io.ReaderAt)
+		if !ok {
+			spill, err := os.CreateTemp("", "s3b-put-*")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("spill file: %v", err), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(spill.Name())
+			defer spill.Close()
+			if n, err := io.Copy(spill, io.LimitReader(body, cl)); err != nil || n != cl {
+				http.Error(w, fmt.Sprintf("read body: got %d of %d bytes (%v)", n, cl, err), http.StatusBadRequest)
+				return
+			}
+			ra = spill
+		}
+		var err error
+		if sums.MD5, err = sectionMD5(ra, cl); err != nil {
+			http.Error(w, fmt.Sprintf("read body: %v", err), http.StatusInternalServerError)
+			return
+		}
+		body = io.NewSectionReader(ra, 0, cl)
+	}
+	d := newDigestReader(body, sums.SHA256 != "")
+	req, err := p.upstreamRequest(r, http.MethodPut, pathUnescaped, rawPath, "", d, cl, ct)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sums.set(req.Header)
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		status := http.StatusBadRequest
+		err := sums.check(d)
+		if err == nil && p.global.VerifyChecksums {
+			status, err = http.StatusBadGateway, checkETag(resp.Header, d.md5Hex())
+		}
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	p.copySafeHeaders(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// verifyCopy checks, with verifyChecksums, that the copy of src at dstKey
+// holds the same bytes: the ETags must match when both are plain MD5s,
+// otherwise (multipart or encrypted copies) the sizes are compared. dst holds
+// the headers of the copy response. A bad copy is removed.
+func (p *proxy) verifyCopy(ctx context.Context, bucket, dstKey string, src objectHead, etag string, dst http.Header) error {
+	if !p.global.VerifyChecksums {
+		return nil
+	}
+	var want, got string
+	if !src.Encrypted {
+		want = plainETag(src.ETag)
+	}
+	if etagIsDigest(dst) {
+		got = plainETag(etag)
+	}
+	var err error
+	if want != "" && got != "" {
+		if want != got {
+			err = fmt.Errorf("%w: copy has ETag %s, source %s", errChecksumMismatch, got, want)
+		}
+	} else {
+		var h objectHead
+		if h, err = p.headObject(ctx, bucket, dstKey); err == nil && h.Size != src.Size {
+			err = fmt.Errorf("%w: copy is %d bytes, source %d", errChecksumMismatch, h.Size, src.Size)
+		}
+	}
+	if errors.Is(err, errChecksumMismatch) {
+		if derr := p.deleteObject(context.WithoutCancel(ctx), bucket, dstKey); derr != nil {
+			err = fmt.Errorf("%w (removing the copy failed: %v)", err, derr)
+		}
+	}
+	return err
+}
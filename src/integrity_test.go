@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckETag(t *testing.T) {
+	const sum = "9e107d9d372bb6826bd81d3542a419d6"
+	const other = "e4d909c290d0fb1ca068ffaddf22cbd0"
+	for _, tc := range []struct {
+		name     string
+		hdr      map[string]string
+		mismatch bool
+	}{
+		{"matching", map[string]string{"ETag": `"` + sum + `"`}, false},
+		{"upper case", map[string]string{"ETag": `"9E107D9D372BB6826BD81D3542A419D6"`}, false},
+		{"mismatch", map[string]string{"ETag": `"` + other + `"`}, true},
+		{"multipart", map[string]string{"ETag": `"` + other + `-3"`}, false},
+		{"no etag", map[string]string{}, false},
+		{"SSE-S3", map[string]string{"ETag": `"` + other + `"`, "X-Amz-Server-Side-Encryption": "AES256"}, true},
+		{"SSE-KMS", map[string]string{"ETag": `"` + other + `"`, "X-Amz-Server-Side-Encryption": "aws:kms"}, false},
+		{"DSSE-KMS", map[string]string{"ETag": `"` + other + `"`, "X-Amz-Server-Side-Encryption": "aws:kms:dsse"}, false},
+		{"SSE-C", map[string]string{"ETag": `"` + other + `"`, "X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256"}, false},
+	} {
+		h := http.Header{}
+		for k, v := range tc.hdr {
+			h.Set(k, v)
+		}
+		err := checkETag(h, sum)
+		if got := errors.Is(err, errChecksumMismatch); got != tc.mismatch {
+			t.Errorf("checkETag(%s) = %v, want mismatch %v", tc.name, err, tc.mismatch)
+		}
+	}
+}
+
+func TestEtagIsDigest(t *testing.T) {
+	for _, tc := range []struct {
+		hdr  map[string]string
+		want bool
+	}{
+		{nil, true},
+		{map[string]string{"X-Amz-Server-Side-Encryption": "AES256"}, true},
+		{map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms"}, false},
+		{map[string]string{"X-Amz-Server-Side-Encryption": "AWS:KMS"}, false},
+		{map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms:dsse"}, false},
+		{map[string]string{"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256"}, false},
+	} {
+		h := http.Header{}
+		for k, v := range tc.hdr {
+			h.Set(k, v)
+		}
+		if got := etagIsDigest(h); got != tc.want {
+			t.Errorf("etagIsDigest(%v) = %v, want %v", tc.hdr, got, tc.want)
+		}
+	}
+}
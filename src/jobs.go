@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	jobRetention    = 24 * time.Hour
+	maxJobErrors    = 100
+	jobStateRunning = "running"
+	jobStateDone    = "done"
+	jobStateFailed  = "failed"
+	jobStateCancel  = "cancelled"
+)
+
+// progress receives per-key events from bulk operations. It travels in the
+// context so that deleteKeys, moveKeys & co. report without knowing whether
+// they run inside a job, a streamed request or a plain one.
+type progress interface {
+	addTotal(objects int, bytes int64)
+	step(key string, bytes int64, err error)
+}
+
+type progressKey struct{}
+
+func withProgress(ctx context.Context, pr progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, pr)
+}
+
+type noProgress struct{}
+
+func (noProgress) addTotal(int, int64)       {}
+func (noProgress) step(string, int64, error) {}
+
+func progressFrom(ctx context.Context) progress {
+	if pr, ok := ctx.Value(progressKey{}).(progress); ok {
+		return pr
+	}
+	return noProgress{}
+}
+
+// job is a bulk operation running detached from the request that created it.
+type job struct {
+	ID      string
+	Type    string
+	Profile string
+	Bucket  string
+	Owner   string
+	Params  any
+	Created time.Time
+
+	done, total, bytes, totalBytes, failed atomic.Int64
+
+	mu       sync.Mutex
+	state    string
+	finished time.Time
+	current  string
+	errs     []keyError
+	err      string
+	result   any
+	cancel   context.CancelFunc
+}
+
+func (j *job) addTotal(n int, b int64) {
+	j.total.Add(int64(n))
+	j.totalBytes.Add(b)
+}
+
+func (j *job) step(key string, b int64, err error) {
+	j.done.Add(1)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.current = key
+	if err != nil {
+		j.failed.Add(1)
+		if len(j.errs) < maxJobErrors {
+			j.errs = append(j.errs, keyError{Key: key, Error: err.Error()})
+		}
+		return
+	}
+	j.bytes.Add(b)
+}
+
+type jobJSON struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Profile    string     `json:"profile"`
+	Bucket     string     `json:"bucket"`
+	Owner      string     `json:"owner,omitempty"`
+	Params     any        `json:"params,omitempty"`
+	Created    time.Time  `json:"created"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	State      string     `json:"state"`
+	Done       int64      `json:"done"`
+	Total      int64      `json:"total"`
+	Bytes      int64      `json:"bytes"`
+	TotalBytes int64      `json:"totalBytes"`
+	Failed     int64      `json:"failed"`
+	Current    string     `json:"current,omitempty"`
+	Errors     []keyError `json:"errors,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Result     any        `json:"result,omitempty"`
+}
+
+func (j *job) snapshot() jobJSON {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := jobJSON{
+		ID:         j.ID,
+		Type:       j.Type,
+		Profile:    j.Profile,
+		Bucket:     j.Bucket,
+		Owner:      j.Owner,
+		Params:     j.Params,
+		Created:    j.Created,
+		State:      j.state,
+		Done:       j.done.Load(),
+		Total:      j.total.Load(),
+		Bytes:      j.bytes.Load(),
+		TotalBytes: j.totalBytes.Load(),
+		Failed:     j.failed.Load(),
+		Current:    j.current,
+		Errors:     append([]keyError(nil), j.errs...),
+		Error:      j.err,
+		Result:     j.result,
+	}
+	if !j.finished.IsZero() {
+		t := j.finished
+		out.Finished = &t
+	}
+	return out
+}
+
+// jobManager keeps jobs in memory for the life of the process; it is shared
+// by every registry so jobs outlive configuration reloads.
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+var jobs = &jobManager{jobs: map[string]*job{}}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (m *jobManager) prune() {
+	for id, j := range m.jobs {
+		j.mu.Lock()
+		old := j.state != jobStateRunning && time.Since(j.finished) > jobRetention
+		j.mu.Unlock()
+		if old {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// start runs fn in the background with a context that is not tied to any
+// request. The result of fn is exposed as the job result.
+func (m *jobManager) start(j *job, fn func(ctx context.Context) (any, error)) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.ID = newJobID()
+	j.Created = time.Now().UTC()
+	j.state = jobStateRunning
+	j.cancel = cancel
+
+	m.mu.Lock()
+	m.prune()
+	m.jobs[j.ID] = j
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		res, err := fn(withProgress(ctx, j))
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.finished = time.Now().UTC()
+		j.result = res
+		switch {
+		case ctx.Err() != nil:
+			j.state = jobStateCancel
+		case err != nil:
+			j.state, j.err = jobStateFailed, err.Error()
+		default:
+			j.state = jobStateDone
+		}
+		log.Printf("job %s (%s %s/%s): %s", j.ID, j.Type, j.Profile, j.Bucket, j.state)
+	}()
+	return j
+}
+
+func (m *jobManager) get(id string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+func (m *jobManager) list() []*job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		out = append(out, j)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out
+}
+
+func ownerName(r *http.Request) string {
+	if id := identityFrom(r.Context()); id != nil {
+		return id.Name
+	}
+	return ""
+}
+
+// wantsAsync reports whether the caller asked for the operation to run as a
+// background job, with ?async=1 or "async": true in the body.
+func wantsAsync(r *http.Request, body bool) bool {
+	if body {
+		return true
+	}
+	switch strings.ToLower(r.URL.Query().Get("async")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// startJob launches fn as a job of the calling proxy and answers 202 with
+// the job description.
+func (p *proxy) startJob(w http.ResponseWriter, r *http.Request, typ, bucket string, params any, fn func(ctx context.Context) (any, error)) {
+	j := jobs.start(&job{Type: typ, Profile: p.name, Bucket: bucket, Owner: ownerName(r), Params: params}, fn)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(j.snapshot())
+}
+
+// visibleJob hides jobs of other profiles and, when authentication is on,
+// of other users.
+func (p *proxy) visibleJob(r *http.Request, j *job) bool {
+	return j != nil && j.Profile == p.name && (j.Owner == "" || j.Owner == ownerName(r))
+}
+
+func (p *proxy) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	out := []jobJSON{}
+	for _, j := range jobs.list() {
+		if p.visibleJob(r, j) {
+			s := j.snapshot()
+			s.Errors, s.Result = nil, nil
+			out = append(out, s)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"jobs": out})
+}
+
+// handleJob serves GET /api/jobs/{id} and cancellation through
+// DELETE /api/jobs/{id} or POST /api/jobs/{id}/cancel.
+func (p *proxy) handleJob(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	id, action, _ := strings.Cut(rest, "/")
+	j := jobs.get(id)
+	if !p.visibleJob(r, j) {
+		http.Error(w, fmt.Sprintf("job %q not found", id), http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && action == "":
+	case r.Method == http.MethodDelete && action == "", r.Method == http.MethodPost && action == "cancel":
+		j.cancel()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(j.snapshot())
+}
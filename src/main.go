@@ -2,15 +2,19 @@ package main
 
 import (
         "context"
+        "crypto/md5"
         "crypto/tls"
         "embed"
         "bytes"
         "mime"
         "path"
 	"encoding/base64"
+	"encoding/hex"
         "encoding/json"
         "encoding/xml"
+        "errors"
         "fmt"
+        "flag"
         "io"
         "io/fs"
         "log"
@@ -18,6 +22,7 @@ import (
         "net/url"
         "os"
         "sort"
+        "sync/atomic"
         "strconv"
         "strings"
         "time"
@@ -59,6 +64,7 @@ type listItemJSON struct {
 }
 
 type listResponseJSON struct {
+    Bucket                string         `json:"bucket"`
     Prefix                string         `json:"prefix"`
     Delimiter             string         `json:"delimiter"`
     Items                 []listItemJSON `json:"items"`
@@ -66,51 +72,26 @@ type listResponseJSON struct {
     IsTruncated           bool           `json:"isTruncated"`
 }
 
-type cfg struct {
-        Endpoint string
-        Region   string
-        AKID     string
-        Secret   string
-        Bucket   string
-        Port     string
-}
-
-func mustEnv(k string) string {
-        v := strings.TrimSpace(os.Getenv(k))
-        if v == "" {
-                log.Fatalf("missing env: %s", k)
-        }
-        return v
-}
-
-func loadCfg() cfg {
-        c := cfg{
-                Endpoint: mustEnv("S3_ENDPOINT"),
-                Region:   mustEnv("S3_REGION"),
-                AKID:     mustEnv("S3_ACCESS_KEY_ID"),
-                Secret:   mustEnv("S3_SECRET_ACCESS_KEY"),
-                Bucket:   mustEnv("S3_BUCKET"),
-                Port:     os.Getenv("PORT"),
-        }
-        if c.Port == "" {
-                c.Port = "8080"
-        }
-        return c
-}
-
 type proxy struct {
-        cfg     cfg
+        name    string
+        cfg     profileCfg
         origin  *url.URL
         client  *http.Client
         signer  *v4.Signer
         creds   aws.Credentials
         hostHdr string
+        policy  *policy
+        global  cfg
+
+        bucketSet     *bucketSet
+        noMultiDelete atomic.Bool
 }
 
-func newProxy(c cfg) *proxy {
+func newProxy(name string, g cfg, pol *policy) (*proxy, error) {
+        c := g.Profiles[name]
         u, err := url.Parse(strings.TrimRight(c.Endpoint, "/"))
-        if err != nil {
-                log.Fatalf("invalid S3_ENDPOINT: %v", err)
+        if err != nil || u.Scheme == "" || u.Host == "" {
+                return nil, fmt.Errorf("invalid endpoint %q", c.Endpoint)
         }
         tr := &http.Transport{
                 Proxy: http.ProxyFromEnvironment,
@@ -119,13 +100,18 @@ func newProxy(c cfg) *proxy {
                 },
         }
         return &proxy{
+                name:    name,
                 cfg:     c,
                 origin:  u,
                 client:  &http.Client{Transport: tr, Timeout: 0},
                 signer:  v4.NewSigner(),
                 creds:   aws.Credentials{AccessKeyID: c.AKID, SecretAccessKey: c.Secret, Source: "static"},
                 hostHdr: u.Host,
-        }
+                policy:  pol.forProfile(name),
+                global:  g,
+
+                bucketSet: &bucketSet{static: c.Buckets, discover: c.DiscoverBuckets},
+        }, nil
 }
 
 func (p *proxy) copySafeHeaders(dst http.ResponseWriter, src *http.Response) {
@@ -164,18 +150,17 @@ func (p *proxy) signAndDo(ctx context.Context, req *http.Request) (*http.Respons
         return p.client.Do(req)
 }
 
-func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathUnescaped, rawPath, rawQuery string, body io.Reader, contentLength int64, contentType string) {
-        ctx := r.Context()
-
+// upstreamRequest builds the backend request for r, carrying over the
+// client headers that matter to S3.
+func (p *proxy) upstreamRequest(r *http.Request, method, pathUnescaped, rawPath, rawQuery string, body io.Reader, contentLength int64, contentType string) (*http.Request, error) {
         u := *p.origin
         u.Path = pathUnescaped
         u.RawPath = rawPath
         u.RawQuery = rawQuery
 
-        req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+        req, err := http.NewRequestWithContext(r.Context(), method, u.String(), body)
         if err != nil {
-                http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
-                return
+                return nil, err
         }
 
         copyHdrs := []string{"Range", "If-None-Match", "If-Modified-Since", "Accept", "User-Agent", "Content-Type"}
@@ -191,6 +176,16 @@ func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathU
                 req.ContentLength = contentLength
                 req.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
         }
+        return req, nil
+}
+
+func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathUnescaped, rawPath, rawQuery string, body io.Reader, contentLength int64, contentType string) {
+        ctx := r.Context()
+        req, err := p.upstreamRequest(r, method, pathUnescaped, rawPath, rawQuery, body, contentLength, contentType)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
 
         resp, err := p.signAndDo(ctx, req)
         if err != nil {
@@ -210,42 +205,194 @@ func (p *proxy) forwardRaw(w http.ResponseWriter, r *http.Request, method, pathU
         }
 }
 
+// Query parameters that may reach S3. Anything else, such as the ?acl,
+// ?policy or ?uploads subresources, is refused.
+var listParams = map[string]bool{"list-type": true, "prefix": true, "delimiter": true, "continuation-token": true, "max-keys": true, "start-after": true, "marker": true}
+
+func isListParam(k string) bool { return listParams[k] }
+
+func isGetParam(k string) bool { return strings.HasPrefix(k, "response-") }
+
+func noParams(string) bool { return false }
+
+// forwardQuery returns the parameters of a client query that are forwarded
+// to S3, without the proxy's own "bucket". An unknown or repeated parameter
+// is an error, so that policy checks and S3 always read the same values.
+func forwardQuery(rawQuery string, allow func(string) bool) (url.Values, error) {
+        q, err := url.ParseQuery(rawQuery)
+        if err != nil {
+                return nil, err
+        }
+        q.Del("bucket")
+        for k, vv := range q {
+                if !allow(k) {
+                        return nil, fmt.Errorf("unsupported query parameter %q", k)
+                }
+                if len(vv) > 1 {
+                        return nil, fmt.Errorf("repeated query parameter %q", k)
+                }
+        }
+        return q, nil
+}
+
 func (p *proxy) handleList(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodGet && r.Method != http.MethodHead {
                 http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
-        pathUnescaped := "/" + p.cfg.Bucket
-        rawPath := "/" + url.PathEscape(p.cfg.Bucket)
-        p.forwardRaw(w, r, r.Method, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
+        bucket, ok := p.requestBucket(w, r)
+        if !ok {
+                return
+        }
+        q, err := forwardQuery(r.URL.RawQuery, isListParam)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        prefix, err := cleanKey(q.Get("prefix"))
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if q.Has("prefix") {
+                q.Set("prefix", prefix)
+        }
+        if !p.authorize(w, r, actRead, bucket, prefix) {
+                return
+        }
+        if p.cfg.RootPrefix != "" || p.global.Thumbs.Cache == thumbCacheBucket {
+                p.handleListJailed(w, r, bucket, q)
+                return
+        }
+        pathUnescaped := "/" + bucket
+        rawPath := "/" + url.PathEscape(bucket)
+        p.forwardRaw(w, r, r.Method, pathUnescaped, rawPath, q.Encode(), nil, 0, "")
+}
+
+// handleListJailed lists through the root prefix and hides the bucket cache
+// of thumbnails, which a plain forward cannot do.
+func (p *proxy) handleListJailed(w http.ResponseWriter, r *http.Request, bucket string, q url.Values) {
+        prefix, err := cleanKey(q.Get("prefix"))
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        q.Set("prefix", p.rootKey(prefix))
+        for _, k := range []string{"start-after", "marker"} {
+                if v := q.Get(k); v != "" {
+                        ck, err := cleanKey(v)
+                        if err != nil {
+                                http.Error(w, err.Error(), http.StatusBadRequest)
+                                return
+                        }
+                        q.Set(k, p.rootKey(ck))
+                }
+        }
+
+        u, _ := p.buildBucketURL(bucket, q)
+        req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
+                return
+        }
+        resp, err := p.signAndDo(r.Context(), req)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
+                return
+        }
+        defer resp.Body.Close()
+        b, err := io.ReadAll(resp.Body)
+        if err != nil {
+                http.Error(w, fmt.Sprintf("read: %v", err), http.StatusBadGateway)
+                return
+        }
+        if resp.StatusCode != http.StatusOK {
+                http.Error(w, fmt.Sprintf("list failed: %s", resp.Status), resp.StatusCode)
+                return
+        }
+        var lb listBucketResultV2
+        if err := xml.Unmarshal(b, &lb); err != nil {
+                http.Error(w, fmt.Sprintf("xml: %v", err), http.StatusBadGateway)
+                return
+        }
+        p.unjailList(&lb)
+        p.hideThumbs(&lb, prefix)
+
+        w.Header().Set("Content-Type", "application/xml")
+        if r.Method == http.MethodHead {
+                return
+        }
+        _, _ = io.WriteString(w, xml.Header)
+        _ = xml.NewEncoder(w).Encode(lb)
 }
 
-func (p *proxy) splitKeyFromURL(r *http.Request) (pathUnescaped, rawPath string, err error) {
+// cleanKey normalises a client supplied key or prefix: leading and repeated
+// slashes are dropped and "." / ".." segments are rejected, so a key can
+// never point outside the configured root prefix.
+func cleanKey(key string) (string, error) {
+        segs := strings.Split(key, "/")
+        out := make([]string, 0, len(segs))
+        for _, s := range segs {
+                switch s {
+                case "":
+                        continue
+                case ".", "..":
+                        return "", fmt.Errorf("invalid key segment %q", s)
+                }
+                out = append(out, s)
+        }
+        k := strings.Join(out, "/")
+        if k != "" && strings.HasSuffix(key, "/") {
+                k += "/"
+        }
+        return k, nil
+}
+
+func (p *proxy) rootKey(key string) string {
+        return p.cfg.RootPrefix + key
+}
+
+func (p *proxy) relKey(key string) string {
+        return strings.TrimPrefix(key, p.cfg.RootPrefix)
+}
+
+func (p *proxy) unjailList(lb *listBucketResultV2) {
+        lb.Prefix = p.relKey(lb.Prefix)
+        for i := range lb.CommonPrefixes {
+                lb.CommonPrefixes[i].Prefix = p.relKey(lb.CommonPrefixes[i].Prefix)
+        }
+        for i := range lb.Contents {
+                lb.Contents[i].Key = p.relKey(lb.Contents[i].Key)
+        }
+}
+
+func keyFromURL(r *http.Request) (string, error) {
         escaped := r.URL.EscapedPath()
         keyPart := strings.TrimPrefix(escaped, "/s3/")
         keyPart = strings.TrimLeft(keyPart, "/")
 
         unescaped, err := url.PathUnescape(keyPart)
         if err != nil {
-                return "", "", err
+                return "", err
         }
+        return cleanKey(unescaped)
+}
 
-        segs := strings.Split(unescaped, "/")
-        segsClean := make([]string, 0, len(segs))
-        segsEsc := make([]string, 0, len(segs))
-        for _, s := range segs {
-                if s == "" {
-                        continue
-                }
-                segsClean = append(segsClean, s)
-                segsEsc = append(segsEsc, url.PathEscape(s))
+func (p *proxy) splitKeyFromURL(r *http.Request, bucket string) (pathUnescaped, rawPath string, err error) {
+        key, err := keyFromURL(r)
+        if err != nil {
+                return "", "", err
+        }
+        if key == "" && p.cfg.RootPrefix != "" {
+                return "", "", fmt.Errorf("empty key")
         }
 
-        pathUnescaped = "/" + p.cfg.Bucket
-        rawPath = "/" + url.PathEscape(p.cfg.Bucket)
-        if len(segsClean) > 0 {
-                pathUnescaped += "/" + strings.Join(segsClean, "/")
-                rawPath += "/" + strings.Join(segsEsc, "/")
+        key = p.rootKey(key)
+        pathUnescaped = "/" + bucket
+        rawPath = "/" + url.PathEscape(bucket)
+        if key != "" {
+                pathUnescaped += "/" + strings.TrimSuffix(key, "/")
+                rawPath += "/" + encodeKeyRaw(key)
         }
         return pathUnescaped, rawPath, nil
 }
@@ -255,12 +402,29 @@ func (p *proxy) handleGetObject(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
-        pathUnescaped, rawPath, err := p.splitKeyFromURL(r)
+        bucket, ok := p.requestBucket(w, r)
+        if !ok {
+                return
+        }
+        key, err := keyFromURL(r)
+        if err != nil {
+                http.Error(w, "bad path", http.StatusBadRequest)
+                return
+        }
+        q, err := forwardQuery(r.URL.RawQuery, isGetParam)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if !p.authorize(w, r, actRead, bucket, key) {
+                return
+        }
+        pathUnescaped, rawPath, err := p.splitKeyFromURL(r, bucket)
         if err != nil {
                 http.Error(w, "bad path", http.StatusBadRequest)
                 return
         }
-        p.forwardRaw(w, r, r.Method, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
+        p.forwardRaw(w, r, r.Method, pathUnescaped, rawPath, q.Encode(), nil, 0, "")
 }
 
 func (p *proxy) handlePutObject(w http.ResponseWriter, r *http.Request) {
@@ -268,7 +432,23 @@ func (p *proxy) handlePutObject(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
-        pathUnescaped, rawPath, err := p.splitKeyFromURL(r)
+        bucket, ok := p.requestBucket(w, r)
+        if !ok {
+                return
+        }
+        key, err := keyFromURL(r)
+        if err != nil {
+                http.Error(w, "bad path", http.StatusBadRequest)
+                return
+        }
+        if _, err := forwardQuery(r.URL.RawQuery, noParams); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if !p.authorize(w, r, actWrite, bucket, key) {
+                return
+        }
+        pathUnescaped, rawPath, err := p.splitKeyFromURL(r, bucket)
         if err != nil {
                 http.Error(w, "bad path", http.StatusBadRequest)
                 return
@@ -276,10 +456,30 @@ func (p *proxy) handlePutObject(w http.ResponseWriter, r *http.Request) {
 
         ct := r.Header.Get("Content-Type")
         cl := r.ContentLength
+        if e := p.checkUpload(bucket, key, cl, ct); e != nil {
+                e.write(w)
+                return
+        }
+        sums, err := checksumsFrom(r.Header)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        body, e := p.sniffBody(bucket, key, ct, r.Body)
+        if e != nil {
+                e.write(w)
+                return
+        }
         if cl < 0 {
+                p.putStream(w, r, body, bucket, key, pathUnescaped, rawPath, ct, sums)
+                return
+        }
+        if sums.any() || p.global.VerifyChecksums {
+                p.putChecked(w, r, pathUnescaped, rawPath, body, cl, ct, sums)
+                return
         }
 
-        p.forwardRaw(w, r, http.MethodPut, pathUnescaped, rawPath, r.URL.RawQuery, r.Body, cl, ct)
+        p.forwardRaw(w, r, http.MethodPut, pathUnescaped, rawPath, "", body, cl, ct)
 }
 
 func (p *proxy) handleDeleteObject(w http.ResponseWriter, r *http.Request) {
@@ -287,40 +487,87 @@ func (p *proxy) handleDeleteObject(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
-        pathUnescaped, rawPath, err := p.splitKeyFromURL(r)
+        bucket, ok := p.requestBucket(w, r)
+        if !ok {
+                return
+        }
+        key, err := keyFromURL(r)
+        if err != nil {
+                http.Error(w, "bad path", http.StatusBadRequest)
+                return
+        }
+        if _, err := forwardQuery(r.URL.RawQuery, noParams); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if !p.authorize(w, r, actDelete, bucket, key) {
+                return
+        }
+        pathUnescaped, rawPath, err := p.splitKeyFromURL(r, bucket)
         if err != nil {
                 http.Error(w, "bad path", http.StatusBadRequest)
                 return
         }
-        p.forwardRaw(w, r, http.MethodDelete, pathUnescaped, rawPath, r.URL.RawQuery, nil, 0, "")
+        p.forwardRaw(w, r, http.MethodDelete, pathUnescaped, rawPath, "", nil, 0, "")
 }
 
 
-func (p *proxy) buildBucketURL(q url.Values) (string, string) {
+func (p *proxy) buildBucketURL(bucket string, q url.Values) (string, string) {
         u := *p.origin
-        u.Path = "/" + p.cfg.Bucket
-        u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
+        u.Path = "/" + bucket
+        u.RawPath = "/" + url.PathEscape(bucket)
         u.RawQuery = q.Encode()
         return u.String(), u.RawPath
 }
 
-func (p *proxy) listAllKeys(ctx context.Context, prefix string) ([]string, error) {
+type objInfo struct {
+        Key          string
+        Size         int64
+        LastModified time.Time
+        ETag         string
+}
+
+func (p *proxy) listAllKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+        objs, err := p.listAllObjects(ctx, bucket, prefix)
+        if err != nil {
+                return nil, err
+        }
+        keys := make([]string, len(objs))
+        for i, o := range objs {
+                keys[i] = o.Key
+        }
+        return keys, nil
+}
+
+func (p *proxy) listAllObjects(ctx context.Context, bucket, prefix string) ([]objInfo, error) {
+        var objs []objInfo
+        err := p.walkObjects(ctx, bucket, prefix, func(o objInfo) error {
+                objs = append(objs, o)
+                return nil
+        })
+        return objs, err
+}
+
+// walkObjects calls fn for every object under prefix, one listing page at a
+// time, so callers that stream do not hold the whole listing in memory.
+func (p *proxy) walkObjects(ctx context.Context, bucket, prefix string, fn func(objInfo) error) error {
         type listBucketResult struct {
                 XMLName               xml.Name `xml:"ListBucketResult"`
                 NextContinuationToken string   `xml:"NextContinuationToken"`
                 Contents              []struct {
-                        Key  string `xml:"Key"`
-                        Size int64  `xml:"Size"`
+                        Key          string    `xml:"Key"`
+                        Size         int64     `xml:"Size"`
+                        LastModified time.Time `xml:"LastModified"`
+                        ETag         string    `xml:"ETag"`
                 } `xml:"Contents"`
         }
 
-        var keys []string
         var token string
         for {
                 q := url.Values{}
                 q.Set("list-type", "2")
-                if prefix != "" {
-                        q.Set("prefix", prefix)
+                if jp := p.rootKey(prefix); jp != "" {
+                        q.Set("prefix", jp)
                 }
                 q.Set("max-keys", "1000")
                 if token != "" {
@@ -328,66 +575,82 @@ func (p *proxy) listAllKeys(ctx context.Context, prefix string) ([]string, error
                 }
 
                 u := *p.origin
-                u.Path = "/" + p.cfg.Bucket
-                u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
+                u.Path = "/" + bucket
+                u.RawPath = "/" + url.PathEscape(bucket)
                 u.RawQuery = q.Encode()
 
                 req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
                 resp, err := p.signAndDo(ctx, req)
                 if err != nil {
-                        return nil, err
+                        return err
                 }
                 b, err := io.ReadAll(resp.Body)
                 resp.Body.Close()
                 if err != nil {
-                        return nil, err
+                        return err
                 }
                 if resp.StatusCode != http.StatusOK {
-                        return nil, fmt.Errorf("list failed: %s", resp.Status)
+                        return fmt.Errorf("list failed: %s", resp.Status)
                 }
                 var lb listBucketResult
                 if err := xml.Unmarshal(b, &lb); err != nil {
-                        return nil, err
+                        return err
                 }
                 for _, c := range lb.Contents {
-                        keys = append(keys, c.Key)
+                        o := objInfo{Key: p.relKey(c.Key), Size: c.Size, LastModified: c.LastModified, ETag: c.ETag}
+                        if err := fn(o); err != nil {
+                                return err
+                        }
                 }
                 if lb.NextContinuationToken == "" {
                         break
                 }
                 token = lb.NextContinuationToken
         }
-        return keys, nil
+        return nil
 }
 
-func (p *proxy) copyObject(ctx context.Context, srcKey, dstKey string) error {
-        dstUnescaped := "/" + p.cfg.Bucket + "/" + strings.TrimLeft(srcToPath(dstKey), "/")
-        dstRaw := "/" + url.PathEscape(p.cfg.Bucket) + "/" + encodeKeyRaw(dstKey)
-
-        u := *p.origin
-        u.Path = dstUnescaped
-        u.RawPath = dstRaw
+// copyObject copies srcKey to dstKey server-side, through a multipart upload
+// when the source is too large for a single CopyObject.
+func (p *proxy) copyObject(ctx context.Context, bucket, srcKey, dstKey string) error {
+        h, err := p.headObject(ctx, bucket, srcKey)
+        if err != nil {
+                return fmt.Errorf("copy failed: %w", err)
+        }
+        if h.Size > maxCopySize {
+                if err := p.multipartCopy(ctx, bucket, srcKey, dstKey, h); err != nil {
+                        return err
+                }
+                return p.verifyCopy(ctx, bucket, dstKey, h, "", nil)
+        }
 
-        req, _ := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
-        copySrc := "/" + p.cfg.Bucket + "/" + encodeKeyRaw(srcKey)
-        req.Header.Set("x-amz-copy-source", copySrc)
+        req, _ := http.NewRequestWithContext(ctx, http.MethodPut, p.objectURL(bucket, dstKey), nil)
+        req.Header.Set("x-amz-copy-source", p.copySource(bucket, srcKey))
 
         resp, err := p.signAndDo(ctx, req)
         if err != nil {
                 return err
         }
-        io.Copy(io.Discard, resp.Body)
+        var result struct {
+                ETag string `xml:"ETag"`
+        }
+        body, _ := io.ReadAll(resp.Body)
         resp.Body.Close()
+        if resp.StatusCode == http.StatusNotFound {
+                return fmt.Errorf("copy failed: %w", errNotFound)
+        }
         if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
                 return fmt.Errorf("copy failed: %s", resp.Status)
         }
-        return nil
+        _ = xml.Unmarshal(body, &result)
+        return p.verifyCopy(ctx, bucket, dstKey, h, result.ETag, resp.Header)
 }
 
-func (p *proxy) deleteObject(ctx context.Context, key string) error {
+func (p *proxy) deleteObject(ctx context.Context, bucket, key string) error {
+        key = p.rootKey(srcToPath(key))
         u := *p.origin
-        u.Path = "/" + p.cfg.Bucket + "/" + strings.TrimLeft(srcToPath(key), "/")
-        u.RawPath = "/" + url.PathEscape(p.cfg.Bucket) + "/" + encodeKeyRaw(key)
+        u.Path = "/" + bucket + "/" + strings.TrimLeft(srcToPath(key), "/")
+        u.RawPath = "/" + url.PathEscape(bucket) + "/" + encodeKeyRaw(key)
 
         req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
         resp, err := p.signAndDo(ctx, req)
@@ -402,6 +665,70 @@ func (p *proxy) deleteObject(ctx context.Context, key string) error {
         return nil
 }
 
+func (p *proxy) objectURL(bucket, key string) string {
+        key = p.rootKey(srcToPath(key))
+        u := *p.origin
+        u.Path = "/" + bucket + "/" + key
+        u.RawPath = "/" + url.PathEscape(bucket) + "/" + encodeKeyRaw(key)
+        return u.String()
+}
+
+func (p *proxy) putObjectBytes(ctx context.Context, bucket, key, contentType string, data []byte) error {
+        req, _ := http.NewRequestWithContext(ctx, http.MethodPut, p.objectURL(bucket, key), bytes.NewReader(data))
+        req.ContentLength = int64(len(data))
+        req.Header.Set("Content-Type", contentType)
+        sum := md5.Sum(data)
+        req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return err
+        }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return fmt.Errorf("put failed: %s", resp.Status)
+        }
+        if p.global.VerifyChecksums {
+                return checkETag(resp.Header, hex.EncodeToString(sum[:]))
+        }
+        return nil
+}
+
+// getObjectBytes reads a small object; errNotFound is returned on 404.
+func (p *proxy) getObjectBytes(ctx context.Context, bucket, key string) ([]byte, error) {
+        req, _ := http.NewRequestWithContext(ctx, http.MethodGet, p.objectURL(bucket, key), nil)
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return nil, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode == http.StatusNotFound {
+                return nil, errNotFound
+        }
+        if resp.StatusCode != http.StatusOK {
+                return nil, fmt.Errorf("get failed: %s", resp.Status)
+        }
+        return io.ReadAll(resp.Body)
+}
+
+func (p *proxy) objectExists(ctx context.Context, bucket, key string) (bool, error) {
+        req, _ := http.NewRequestWithContext(ctx, http.MethodHead, p.objectURL(bucket, key), nil)
+        resp, err := p.signAndDo(ctx, req)
+        if err != nil {
+                return false, err
+        }
+        resp.Body.Close()
+        switch resp.StatusCode {
+        case http.StatusOK:
+                return true, nil
+        case http.StatusNotFound:
+                return false, nil
+        }
+        return false, fmt.Errorf("head failed: %s", resp.Status)
+}
+
+var errNotFound = errors.New("not found")
+
 func encodeKeyRaw(key string) string {
         segs := strings.Split(key, "/")
         enc := make([]string, 0, len(segs))
@@ -419,23 +746,13 @@ func srcToPath(s string) string {
 }
 
 
-type listBucketResult struct {
-        XMLName               xml.Name `xml:"ListBucketResult"`
-        NextContinuationToken string   `xml:"NextContinuationToken"`
-        Contents              []struct {
-                Key          string    `xml:"Key"`
-                LastModified time.Time `xml:"LastModified"`
-                Size         int64     `xml:"Size"`
-                ETag         string    `xml:"ETag"`
-        } `xml:"Contents"`
-}
-
 type agg struct {
         Count int64 `json:"count"`
         Bytes int64 `json:"bytes"`
 }
 
 type statsResponse struct {
+        Bucket     string         `json:"bucket"`
         Prefix     string         `json:"prefix"`
         Count      int64          `json:"count"`
         TotalBytes int64          `json:"totalBytes"`
@@ -483,100 +800,88 @@ func (p *proxy) handleStats(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
                 return
         }
-        prefix := r.URL.Query().Get("prefix")
+        bucket, ok := p.requestBucket(w, r)
+        if !ok {
+                return
+        }
+        prefix, err := cleanKey(r.URL.Query().Get("prefix"))
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        id := identityFrom(r.Context())
+        if !p.policy.visible(id, bucket, prefix) {
+                http.Error(w, "forbidden", http.StatusForbidden)
+                return
+        }
 
+        if streamMode(r) != "" {
+                p.stream(w, r, func(ctx context.Context) (any, error) {
+                        return p.computeStats(ctx, bucket, prefix, id)
+                })
+                return
+        }
+        out, err := p.computeStats(r.Context(), bucket, prefix, id)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadGateway)
+                return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(out)
+}
+
+func (p *proxy) computeStats(ctx context.Context, bucket, prefix string, id *identity) (statsResponse, error) {
         start := time.Now()
-        ctx := r.Context()
+        pr := progressFrom(ctx)
 
         out := statsResponse{
+                Bucket:   bucket,
                 Prefix:   prefix,
                 ByType:   map[string]agg{},
                 ByFolder: map[string]agg{},
         }
 
-        var token string
-        for {
-                q := url.Values{}
-                q.Set("list-type", "2")
-                if prefix != "" {
-                        q.Set("prefix", prefix)
+        err := p.walkObjects(ctx, bucket, prefix, func(c objInfo) error {
+                if strings.HasSuffix(c.Key, "/") && c.Size == 0 {
+                        return nil
                 }
-                q.Set("max-keys", "1000")
-                if token != "" {
-                        q.Set("continuation-token", token)
+                if p.skipThumb(prefix, c.Key) || !p.policy.allowed(id, actRead, bucket, c.Key) {
+                        return nil
                 }
+                pr.step(c.Key, c.Size, nil)
+                out.Count++
+                out.TotalBytes += c.Size
 
-                u := *p.origin
-                u.Path = "/" + p.cfg.Bucket
-                u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
-                u.RawQuery = q.Encode()
-
-                req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("new request: %v", err), http.StatusInternalServerError)
-                        return
+                if out.Newest == nil || c.LastModified.After(*out.Newest) {
+                        t := c.LastModified
+                        out.Newest = &t
                 }
-                resp, err := p.signAndDo(ctx, req)
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
-                        return
-                }
-                body, err := io.ReadAll(resp.Body)
-                resp.Body.Close()
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("read: %v", err), http.StatusBadGateway)
-                        return
-                }
-                if resp.StatusCode != http.StatusOK {
-                        http.Error(w, fmt.Sprintf("list failed: %s", resp.Status), resp.StatusCode)
-                        return
+                if out.Oldest == nil || c.LastModified.Before(*out.Oldest) {
+                        t := c.LastModified
+                        out.Oldest = &t
                 }
 
-                var lb listBucketResult
-                if err := xml.Unmarshal(body, &lb); err != nil {
-                        http.Error(w, fmt.Sprintf("xml: %v", err), http.StatusBadGateway)
-                        return
-                }
-
-                for _, c := range lb.Contents {
-                        if strings.HasSuffix(c.Key, "/") && c.Size == 0 {
-                                continue
-                        }
-                        out.Count++
-                        out.TotalBytes += c.Size
+                kind := detectKind(c.Key)
+                aggT := out.ByType[kind]
+                aggT.Count++
+                aggT.Bytes += c.Size
+                out.ByType[kind] = aggT
 
-                        if out.Newest == nil || c.LastModified.After(*out.Newest) {
-                                t := c.LastModified
-                                out.Newest = &t
-                        }
-                        if out.Oldest == nil || c.LastModified.Before(*out.Oldest) {
-                                t := c.LastModified
-                                out.Oldest = &t
-                        }
-
-                        kind := detectKind(c.Key)
-                        aggT := out.ByType[kind]
-                        aggT.Count++
-                        aggT.Bytes += c.Size
-                        out.ByType[kind] = aggT
-
-                        rest := c.Key
-                        if prefix != "" && strings.HasPrefix(rest, prefix) {
-                                rest = strings.TrimPrefix(rest, prefix)
-                        }
-                        if i := strings.IndexByte(rest, '/'); i >= 0 {
-                                folder := rest[:i+1]
-                                ag := out.ByFolder[folder]
-                                ag.Count++
-                                ag.Bytes += c.Size
-                                out.ByFolder[folder] = ag
-                        }
+                rest := c.Key
+                if prefix != "" && strings.HasPrefix(rest, prefix) {
+                        rest = strings.TrimPrefix(rest, prefix)
                 }
-
-                if lb.NextContinuationToken == "" {
-                        break
+                if i := strings.IndexByte(rest, '/'); i >= 0 {
+                        folder := rest[:i+1]
+                        ag := out.ByFolder[folder]
+                        ag.Count++
+                        ag.Bytes += c.Size
+                        out.ByFolder[folder] = ag
                 }
-                token = lb.NextContinuationToken
+                return nil
+        })
+        if err != nil {
+                return out, err
         }
 
         type kv struct {
@@ -603,21 +908,38 @@ func (p *proxy) handleStats(w http.ResponseWriter, r *http.Request) {
         out.ByFolder = trimmed
 
         out.TookMs = time.Since(start).Milliseconds()
-
-        w.Header().Set("Content-Type", "application/json")
-        _ = json.NewEncoder(w).Encode(out)
+        return out, nil
 }
 
 
 type renameRequest struct {
-        Src      string `json:"src"`  
-        Dst      string `json:"dst"`  
-        IsPrefix bool   `json:"isPrefix"` 
+        Bucket      string `json:"bucket,omitempty"`
+        Src         string `json:"src"`  
+        Dst         string `json:"dst"`  
+        IsPrefix    bool   `json:"isPrefix"` 
+        Concurrency int    `json:"concurrency,omitempty"`
+        Async       bool   `json:"async,omitempty"`
 }
 
 type renameResponse struct {
-        Moved int   `json:"moved"`
-        Took  int64 `json:"tookMs"`
+        ID        string     `json:"id,omitempty"`
+        Status    string     `json:"status"`
+        Moved     int        `json:"moved"`
+        Succeeded []string   `json:"succeeded"`
+        Failed    []keyError `json:"failed"`
+        Took      int64      `json:"tookMs"`
+}
+
+// checkPrefixPair refuses folder moves and copies that would take the whole
+// bucket, or write under their own source and so list their own output.
+func checkPrefixPair(src, dst string) error {
+        if src == "" {
+                return fmt.Errorf("src is required: the bucket root cannot be moved or copied")
+        }
+        if strings.HasPrefix(dst, src) {
+                return fmt.Errorf("dst %q is inside src %q", dst, src)
+        }
+        return nil
 }
 
 func (p *proxy) handleRename(w http.ResponseWriter, r *http.Request) {
@@ -631,9 +953,33 @@ func (p *proxy) handleRename(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "bad json", http.StatusBadRequest)
                 return
         }
+        if req.Bucket == "" {
+                req.Bucket = r.URL.Query().Get("bucket")
+        }
+        bucket, ok := p.resolveBucket(w, r, req.Bucket)
+        if !ok {
+                return
+        }
+
+        var err error
+        if req.Src, err = cleanKey(req.Src); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if req.Dst, err = cleanKey(req.Dst); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if !req.IsPrefix && (req.Src == "" || req.Dst == "") {
+                http.Error(w, "src and dst are required", http.StatusBadRequest)
+                return
+        }
+        if !req.IsPrefix && req.Src == req.Dst {
+                http.Error(w, "src and dst are the same key", http.StatusBadRequest)
+                return
+        }
 
         start := time.Now()
-        moved := 0
 
         if req.IsPrefix {
                 src := strings.TrimLeft(req.Src, "/")
@@ -644,49 +990,80 @@ func (p *proxy) handleRename(w http.ResponseWriter, r *http.Request) {
                 if dst != "" && !strings.HasSuffix(dst, "/") {
                         dst += "/"
                 }
-                keys, err := p.listAllKeys(ctx, src)
-                if err != nil {
-                        http.Error(w, fmt.Sprintf("list: %v", err), http.StatusBadGateway)
+                if err := checkPrefixPair(src, dst); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
                         return
                 }
-                for _, k := range keys {
-                        if strings.HasSuffix(k, "/") {
-                                continue
-                        }
-                        newKey := dst + strings.TrimPrefix(k, src)
-                        if err := p.copyObject(ctx, k, newKey); err != nil {
-                                http.Error(w, fmt.Sprintf("copy %s -> %s: %v", k, newKey, err), http.StatusBadGateway)
-                                return
-                        }
-                        if err := p.deleteObject(ctx, k); err != nil {
-                                http.Error(w, fmt.Sprintf("delete %s: %v", k, err), http.StatusBadGateway)
-                                return
-                        }
-                        moved++
+                if !p.authorize(w, r, actRead, bucket, src) || !p.authorize(w, r, actDelete, bucket, src) || !p.authorize(w, r, actWrite, bucket, dst) {
+                        return
                 }
-        } else {
-                if err := p.copyObject(ctx, req.Src, req.Dst); err != nil {
-                        http.Error(w, fmt.Sprintf("copy %s -> %s: %v", req.Src, req.Dst, err), http.StatusBadGateway)
+                if wantsAsync(r, req.Async) {
+                        p.startJob(w, r, "rename", bucket, map[string]string{"src": src, "dst": dst}, func(ctx context.Context) (any, error) {
+                                j, moved, err := p.renamePrefix(ctx, bucket, src, dst, req.Concurrency)
+                                if j == nil {
+                                        return nil, err
+                                }
+                                return j.response(moved, start), err
+                        })
                         return
                 }
-                if err := p.deleteObject(ctx, req.Src); err != nil {
-                        http.Error(w, fmt.Sprintf("delete %s: %v", req.Src, err), http.StatusBadGateway)
+                if streamMode(r) != "" {
+                        p.stream(w, r, func(ctx context.Context) (any, error) {
+                                j, moved, err := p.renamePrefix(ctx, bucket, src, dst, req.Concurrency)
+                                if j == nil {
+                                        return nil, err
+                                }
+                                return j.response(moved, start), err
+                        })
                         return
                 }
-                moved = 1
+                j, moved, err := p.renamePrefix(ctx, bucket, src, dst, req.Concurrency)
+                if j == nil {
+                        http.Error(w, fmt.Sprintf("rename: %v", err), http.StatusBadGateway)
+                        return
+                }
+                if err != nil {
+                        log.Printf("rename %s: journal: %v", j.ID, err)
+                }
+                w.Header().Set("Content-Type", "application/json")
+                _ = json.NewEncoder(w).Encode(j.response(moved, start))
+                return
         }
 
-        out := renameResponse{Moved: moved, Took: time.Since(start).Milliseconds()}
+        if !p.authorize(w, r, actRead, bucket, req.Src) || !p.authorize(w, r, actDelete, bucket, req.Src) || !p.authorize(w, r, actWrite, bucket, req.Dst) {
+                return
+        }
+        if e := checkKey(p.uploadRule(bucket, req.Dst), req.Dst); e != nil {
+                e.write(w)
+                return
+        }
+        if err := withRetry(ctx, func() error { return p.copyObject(ctx, bucket, req.Src, req.Dst) }); errors.Is(err, errNotFound) {
+                http.Error(w, fmt.Sprintf("%s not found", req.Src), http.StatusNotFound)
+                return
+        } else if err != nil {
+                http.Error(w, fmt.Sprintf("copy %s -> %s: %v", req.Src, req.Dst, err), http.StatusBadGateway)
+                return
+        }
+        if err := withRetry(ctx, func() error { return p.deleteObject(ctx, bucket, req.Src) }); err != nil {
+                http.Error(w, fmt.Sprintf("delete %s: %v", req.Src, err), http.StatusBadGateway)
+                return
+        }
+
+        out := renameResponse{Status: renameStatusDone, Moved: 1, Succeeded: []string{req.Src}, Failed: []keyError{}, Took: time.Since(start).Milliseconds()}
         w.Header().Set("Content-Type", "application/json")
         _ = json.NewEncoder(w).Encode(out)
 }
 
 type deletePrefixRequest struct {
+        Bucket string `json:"bucket,omitempty"`
         Prefix string `json:"prefix"`
+        Async  bool   `json:"async,omitempty"`
 }
 type deletePrefixResponse struct {
-        Deleted int   `json:"deleted"`
-        Took    int64 `json:"tookMs"`
+        Deleted int        `json:"deleted"`
+        Failed  int        `json:"failed"`
+        Errors  []keyError `json:"errors,omitempty"`
+        Took    int64      `json:"tookMs"`
 }
 
 func (p *proxy) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
@@ -700,26 +1077,42 @@ func (p *proxy) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
                 http.Error(w, "bad json", http.StatusBadRequest)
                 return
         }
-        pfx := strings.TrimLeft(req.Prefix, "/")
+        if req.Bucket == "" {
+                req.Bucket = r.URL.Query().Get("bucket")
+        }
+        bucket, ok := p.resolveBucket(w, r, req.Bucket)
+        if !ok {
+                return
+        }
+        pfx, err := cleanKey(req.Prefix)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
         if pfx != "" && !strings.HasSuffix(pfx, "/") {
                 pfx += "/"
         }
+        if !p.authorize(w, r, actDeletePrefix, bucket, pfx) {
+                return
+        }
 
-        start := time.Now()
-        keys, err := p.listAllKeys(ctx, pfx)
-        if err != nil {
-                http.Error(w, fmt.Sprintf("list: %v", err), http.StatusBadGateway)
+        if wantsAsync(r, req.Async) {
+                p.startJob(w, r, "delete-prefix", bucket, map[string]string{"prefix": pfx}, func(ctx context.Context) (any, error) {
+                        return p.deletePrefix(ctx, bucket, pfx)
+                })
                 return
         }
-        deleted := 0
-        for _, k := range keys {
-                if err := p.deleteObject(ctx, k); err != nil {
-                        http.Error(w, fmt.Sprintf("delete %s: %v", k, err), http.StatusBadGateway)
-                        return
-                }
-                deleted++
+        if streamMode(r) != "" {
+                p.stream(w, r, func(ctx context.Context) (any, error) {
+                        return p.deletePrefix(ctx, bucket, pfx)
+                })
+                return
+        }
+        out, err := p.deletePrefix(ctx, bucket, pfx)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadGateway)
+                return
         }
-        out := deletePrefixResponse{Deleted: deleted, Took: time.Since(start).Milliseconds()}
         w.Header().Set("Content-Type", "application/json")
         _ = json.NewEncoder(w).Encode(out)
 }
@@ -755,7 +1148,7 @@ func decodeCursor(s string) (ffCursor, error) {
     return c, nil
 }
 
-func (p *proxy) s3ListPage(ctx context.Context, prefix, delimiter, startAfter string, maxKeys int) (*listBucketResultV2, error) {
+func (p *proxy) s3ListPage(ctx context.Context, bucket, prefix, delimiter, startAfter string, maxKeys int) (*listBucketResultV2, error) {
     if delimiter == "" { delimiter = "/" }
     if maxKeys <= 0 || maxKeys > 1000 { maxKeys = 1000 }
 
@@ -763,12 +1156,12 @@ func (p *proxy) s3ListPage(ctx context.Context, prefix, delimiter, startAfter st
     q.Set("list-type", "2")
     q.Set("delimiter", delimiter)
     q.Set("max-keys", strconv.Itoa(maxKeys))
-    if prefix != "" { q.Set("prefix", prefix) }
-    if startAfter != "" { q.Set("start-after", startAfter) }
+    if jp := p.rootKey(prefix); jp != "" { q.Set("prefix", jp) }
+    if startAfter != "" { q.Set("start-after", p.rootKey(startAfter)) }
 
     u := *p.origin
-    u.Path = "/" + p.cfg.Bucket
-    u.RawPath = "/" + url.PathEscape(p.cfg.Bucket)
+    u.Path = "/" + bucket
+    u.RawPath = "/" + url.PathEscape(bucket)
     u.RawQuery = q.Encode()
 
     req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
@@ -787,6 +1180,7 @@ func (p *proxy) s3ListPage(ctx context.Context, prefix, delimiter, startAfter st
 
     var lb listBucketResultV2
     if err := xml.Unmarshal(b, &lb); err != nil { return nil, err }
+    p.unjailList(&lb)
     return &lb, nil
 }
 func parseExcludes(r *http.Request) []string {
@@ -818,7 +1212,15 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
     }
     ctx := r.Context()
 
-    prefix := strings.TrimLeft(r.URL.Query().Get("prefix"), "/")
+    bucket, ok := p.requestBucket(w, r)
+    if !ok {
+        return
+    }
+    prefix, err := cleanKey(r.URL.Query().Get("prefix"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
     delimiter := r.URL.Query().Get("delimiter")
     if delimiter == "" { delimiter = "/" }
 
@@ -828,6 +1230,11 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
     }
 
         excludes := parseExcludes(r)
+        id := identityFrom(ctx)
+        if !p.policy.visible(id, bucket, prefix) {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
 
         cur, err := decodeCursor(r.URL.Query().Get("continuationToken"))
     if err != nil {
@@ -863,7 +1270,7 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
         }
         if prefix != "" && sa != "" { sa = prefix + sa }
 
-        lb, err := p.s3ListPage(ctx, prefix, delimiter, sa, innerMax)
+        lb, err := p.s3ListPage(ctx, bucket, prefix, delimiter, sa, innerMax)
         if err != nil {
             http.Error(w, fmt.Sprintf("upstream: %v", err), http.StatusBadGateway)
             return
@@ -878,7 +1285,8 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
                     rel = strings.TrimPrefix(rel, prefix)
                 }
                 if rel == "" || !strings.HasSuffix(rel, "/") { continue }
-                if isExcluded(rel, excludes) { continue }
+                if isExcluded(rel, excludes) || p.skipThumb(prefix, cp.Prefix) { continue }
+                if !p.policy.visible(id, bucket, cp.Prefix) { cur.After = rel; continue }
 
                 if _, ok := seenDirs[cp.Prefix]; ok { continue }
                 seenDirs[cp.Prefix] = struct{}{}
@@ -923,13 +1331,15 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
         }
 
                 if cur.Phase == "file" {
+            hidden := false
             for _, c := range lb.Contents {
                 if strings.HasSuffix(c.Key, "/") && c.Size == 0 { continue }
                 rel := c.Key
                 if prefix != "" && strings.HasPrefix(rel, prefix) {
                     rel = strings.TrimPrefix(rel, prefix)
                 }
-                if isExcluded(rel, excludes) { continue }
+                if isExcluded(rel, excludes) || p.skipThumb(prefix, c.Key) { continue }
+                if !p.policy.allowed(id, actRead, bucket, c.Key) { cur.After = rel; hidden = true; continue }
 
                 name := c.Key
                 if i := strings.LastIndexByte(name, '/'); i >= 0 { name = name[i+1:] }
@@ -953,6 +1363,7 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
                 break
             }
             if !progress {
+                if hidden && lb.IsTruncated { continue }
                 hasMore = false
                 break
             }
@@ -961,6 +1372,7 @@ func (p *proxy) handleListJSON(w http.ResponseWriter, r *http.Request) {
     }
 
     out := listResponseJSON{
+        Bucket:    bucket,
         Prefix:    prefix,
         Delimiter: delimiter,
         Items:     items,
@@ -983,9 +1395,13 @@ func withCORS(h http.Handler) http.Handler {
                 w.Header().Set("Access-Control-Allow-Origin", "*")
                 w.Header().Set("Vary", "Origin")
                 if r.Method == http.MethodOptions {
-                        w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, DELETE, POST, OPTIONS")
+                        w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, DELETE, POST, PATCH, OPTIONS")
                         w.Header().Set("Access-Control-Allow-Headers",
-                                "Content-Type, Content-Length, Range, If-None-Match, If-Modified-Since, Accept, User-Agent")
+                                "Content-Type, Content-Length, Range, If-None-Match, If-Modified-Since, Accept, User-Agent, Authorization, "+
+                                        "Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+                        if strings.Contains(r.URL.Path, "/api/tus") {
+                                setTusHeaders(w.Header())
+                        }
                         w.WriteHeader(http.StatusNoContent)
                         return
                 }
@@ -1060,13 +1476,28 @@ func (p *proxy) routes() http.Handler {
 	mux.HandleFunc("/api/list", p.handleListJSON)
         mux.HandleFunc("/api/stats", p.handleStats)
         mux.HandleFunc("/api/rename", p.handleRename)
+        mux.HandleFunc("/api/copy", p.handleCopy)
+        mux.HandleFunc("/api/archive", p.handleArchive)
+        mux.HandleFunc("/api/archive-entries", p.handleArchiveEntries)
+        mux.HandleFunc("/api/archive-entry", p.handleArchiveEntry)
+        mux.HandleFunc("/api/extract", p.handleExtract)
+        mux.HandleFunc("/api/thumb", p.handleThumb)
+        mux.HandleFunc("/api/multipart/initiate", p.handleMultipartInitiate)
+        mux.HandleFunc("/api/multipart/part", p.handleMultipartPart)
+        mux.HandleFunc("/api/multipart/complete", p.handleMultipartComplete)
+        mux.HandleFunc("/api/multipart/abort", p.handleMultipartAbort)
+        mux.HandleFunc("/api/multipart/parts", p.handleMultipartParts)
+        mux.HandleFunc("/api/tus/", p.handleTus)
+        mux.HandleFunc("/api/rename/resume", p.handleRenameResume)
+        mux.HandleFunc("/api/rename/rollback", p.handleRenameRollback)
         mux.HandleFunc("/api/delete-prefix", p.handleDeletePrefix)
-
-        publicFS, err := fs.Sub(embeddedPublic, "public")
-	if err != nil {
-		log.Fatalf("embed public: %v", err)
-	}
-	mux.Handle("/", spaFileServerFS(publicFS))
+        mux.HandleFunc("/api/jobs", p.handleJobs)
+        mux.HandleFunc("/api/jobs/", p.handleJob)
+        mux.HandleFunc("/api/buckets", p.handleBuckets)
+        mux.HandleFunc("/api/config", p.handleConfig)
+        mux.HandleFunc("/api/trash", p.handleTrash)
+        mux.HandleFunc("/api/trash/list", p.handleTrashList)
+        mux.HandleFunc("/api/trash/restore", p.handleTrashRestore)
 
         mux.HandleFunc("/s3", func(w http.ResponseWriter, r *http.Request) {
                 switch r.Method {
@@ -1094,23 +1525,49 @@ func (p *proxy) routes() http.Handler {
                 }
         })
 
-        mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-                ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-                defer cancel()
-                _ = ctx
-                w.WriteHeader(http.StatusOK)
-                _, _ = w.Write([]byte("ok\n"))
-        })
+        return mux
+}
 
-        return withCORS(mux)
+// server dispatches to the current registry, which a configuration reload
+// swaps atomically. In-flight requests keep the registry they started with.
+type server struct {
+        path    string
+        current atomic.Pointer[registry]
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+        s.current.Load().handler.ServeHTTP(w, r)
 }
 
 func main() {
-        c := loadCfg()
-        p := newProxy(c)
+        configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML configuration file")
+        flag.Parse()
+
+        c, err := loadCfg(*configPath)
+        if err != nil {
+                log.Fatalf("config:\n%v", err)
+        }
+        // Rename journals, tus uploads and thumbnails create their own
+        // folders; this only makes a bad stateDir fail at startup.
+        if err := os.MkdirAll(c.StateDir, 0o700); err != nil {
+                log.Fatalf("stateDir: %v", err)
+        }
+        reg, err := newRegistry(c)
+        if err != nil {
+                log.Fatal(err)
+        }
+        srv := &server{path: *configPath}
+        srv.current.Store(reg)
+        go srv.watch()
+        go srv.purgeTrashLoop()
+
         addr := ":" + c.Port
-        log.Printf("garage-s3-proxy listening on %s (bucket=%s, endpoint=%s)", addr, c.Bucket, c.Endpoint)
-        if err := http.ListenAndServe(addr, p.routes()); err != nil {
+        for _, name := range reg.names {
+                pc := c.Profiles[name]
+                log.Printf("profile %s: endpoint=%s bucket=%s buckets=%d", name, pc.Endpoint, pc.Bucket, len(pc.Buckets))
+        }
+        log.Printf("garage-s3-proxy listening on %s (profiles=%d, default=%s)", addr, len(reg.names), reg.def)
+        if err := http.ListenAndServe(addr, srv); err != nil {
                 log.Fatal(err)
         }
 }
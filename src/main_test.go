@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func TestForwardQuery(t *testing.T) {
+	for _, tc := range []struct {
+		raw     string
+		allow   func(string) bool
+		want    string
+		wantErr bool
+	}{
+		{"list-type=2&prefix=a%2F&bucket=b", isListParam, "list-type=2&prefix=a%2F", false},
+		{"prefix=a/&prefix=b/", isListParam, "", true},
+		{"acl", isListParam, "", true},
+		{"policy=", isListParam, "", true},
+		{"versions&prefix=a/", isListParam, "", true},
+		{"response-content-type=text%2Fplain", isGetParam, "response-content-type=text%2Fplain", false},
+		{"tagging", isGetParam, "", true},
+		{"versionId=3", isGetParam, "", true},
+		{"bucket=b", noParams, "", false},
+		{"uploadId=1", noParams, "", true},
+		{"%zz", isListParam, "", true},
+	} {
+		q, err := forwardQuery(tc.raw, tc.allow)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("forwardQuery(%q) error = %v, want error %v", tc.raw, err, tc.wantErr)
+			continue
+		}
+		if err == nil && q.Encode() != tc.want {
+			t.Errorf("forwardQuery(%q) = %q, want %q", tc.raw, q.Encode(), tc.want)
+		}
+	}
+}
+
+func TestCleanKey(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"a/b.txt", "a/b.txt", false},
+		{"/a//b/", "a/b/", false},
+		{"a/b/", "a/b/", false},
+		{"//a///b", "a/b", false},
+		{"a/./b", "", true},
+		{"../etc/passwd", "", true},
+		{"a/../../b", "", true},
+		{"a/..", "", true},
+		{"..a/b..", "..a/b..", false},
+	} {
+		got, err := cleanKey(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("cleanKey(%q) = %q, %v; want %q, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestRootKey(t *testing.T) {
+	jailed := &proxy{cfg: profileCfg{RootPrefix: "tenants/acme/"}}
+	open := &proxy{}
+	for _, tc := range []struct {
+		p        *proxy
+		key      string
+		root     string
+		relative string
+	}{
+		{jailed, "", "tenants/acme/", ""},
+		{jailed, "a/b.txt", "tenants/acme/a/b.txt", "a/b.txt"},
+		{jailed, "dir/", "tenants/acme/dir/", "dir/"},
+		{open, "a/b.txt", "a/b.txt", "a/b.txt"},
+	} {
+		got := tc.p.rootKey(tc.key)
+		if got != tc.root {
+			t.Errorf("rootKey(%q) = %q, want %q", tc.key, got, tc.root)
+		}
+		if rel := tc.p.relKey(got); rel != tc.relative {
+			t.Errorf("relKey(%q) = %q, want %q", got, rel, tc.relative)
+		}
+	}
+	// Keys outside the root are never listed; relKey leaves them untouched
+	// rather than making them look like keys of the jail.
+	if got := jailed.relKey("tenants/other/x"); got != "tenants/other/x" {
+		t.Errorf("relKey outside the root = %q", got)
+	}
+}
+
+func TestCheckPrefixPair(t *testing.T) {
+	for _, tc := range []struct {
+		src, dst string
+		ok       bool
+	}{
+		{"a/", "b/", true},
+		{"a/b/", "a/", true},
+		{"a/", "", true},
+		{"a/", "ab/", true},
+		{"", "b/", false},
+		{"a/", "a/", false},
+		{"a/", "a/b/", false},
+	} {
+		if err := checkPrefixPair(tc.src, tc.dst); (err == nil) != tc.ok {
+			t.Errorf("checkPrefixPair(%q, %q) = %v, want ok %v", tc.src, tc.dst, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxCopySize     = 5 << 30 // largest object a single CopyObject accepts
+	copyPartSize    = 512 << 20
+	copyPartWorkers = 4
+	maxParts        = 10000
+)
+
+// preservedHeaders are the object headers carried over when an object is
+// rebuilt with a multipart upload, in addition to x-amz-meta-*.
+var preservedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires", "X-Amz-Storage-Class", "X-Amz-Website-Redirect-Location"}
+
+type objectHead struct {
+	Size         int64
+	ETag         string
+	Encrypted    bool // SSE-KMS or SSE-C: the ETag is not an MD5
+	LastModified time.Time
+	Header       http.Header // preserved headers and user metadata
+}
+
+// headObject returns the size and metadata of key; errNotFound on 404.
+func (p *proxy) headObject(ctx context.Context, bucket, key string) (objectHead, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodHead, p.objectURL(bucket, key), nil)
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return objectHead{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return objectHead{}, errNotFound
+	default:
+		return objectHead{}, fmt.Errorf("head failed: %s", resp.Status)
+	}
+	h := objectHead{Size: resp.ContentLength, ETag: resp.Header.Get("ETag"), Encrypted: !etagIsDigest(resp.Header), Header: http.Header{}}
+	h.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for _, k := range preservedHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			h.Header.Set(k, v)
+		}
+	}
+	for k, vv := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			h.Header[k] = vv
+		}
+	}
+	return h, nil
+}
+
+func (p *proxy) copySource(bucket, key string) string {
+	return "/" + bucket + "/" + encodeKeyRaw(p.rootKey(srcToPath(key)))
+}
+
+func (p *proxy) uploadURL(bucket, key string, q url.Values) string {
+	return p.objectURL(bucket, key) + "?" + q.Encode()
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber" json:"partNumber"`
+	ETag       string `xml:"ETag" json:"etag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e s3Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// doXML sends req and decodes a successful XML answer into out. S3 may
+// report errors with a 200 status on long-running calls such as
+// CompleteMultipartUpload, so an <Error> body is an error too.
+func (p *proxy) doXML(ctx context.Context, req *http.Request, what string, out any) error {
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var se s3Error
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s failed: %w", what, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if xml.Unmarshal(b, &se) == nil && se.Code != "" {
+			return fmt.Errorf("%s failed: %s: %w", what, resp.Status, se)
+		}
+		return fmt.Errorf("%s failed: %s", what, resp.Status)
+	}
+	if bytes.Contains(b, []byte("<Error>")) && xml.Unmarshal(b, &se) == nil && se.Code != "" {
+		return fmt.Errorf("%s failed: %w", what, se)
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return xml.Unmarshal(b, out)
+}
+
+// createMultipart starts a multipart upload of key with the given object
+// headers and returns its upload id.
+func (p *proxy) createMultipart(ctx context.Context, bucket, key string, hdr http.Header) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, p.uploadURL(bucket, key, url.Values{"uploads": {""}}), nil)
+	for k, vv := range hdr {
+		req.Header[k] = vv
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := p.doXML(ctx, req, "create multipart upload", &res); err != nil {
+		return "", err
+	}
+	if res.UploadID == "" {
+		return "", fmt.Errorf("create multipart upload: no upload id")
+	}
+	return res.UploadID, nil
+}
+
+// uploadPartCopy copies bytes [first, last] of src into part n of the upload.
+func (p *proxy) uploadPartCopy(ctx context.Context, bucket, key, uploadID string, n int, src string, first, last int64) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, p.uploadURL(bucket, key, q), nil)
+	req.Header.Set("x-amz-copy-source", p.copySource(bucket, src))
+	req.Header.Set("x-amz-copy-source-range", fmt.Sprintf("bytes=%d-%d", first, last))
+	var res struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := p.doXML(ctx, req, fmt.Sprintf("copy part %d", n), &res); err != nil {
+		return "", err
+	}
+	return res.ETag, nil
+}
+
+// completeMultipart assembles the parts, in part number order.
+func (p *proxy) completeMultipart(ctx context.Context, bucket, key, uploadID string, parts []completedPart) (string, error) {
+	sort.Slice(parts, func(a, b int) bool { return parts[a].PartNumber < parts[b].PartNumber })
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, p.uploadURL(bucket, key, url.Values{"uploadId": {uploadID}}), bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/xml")
+	var res struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := p.doXML(ctx, req, "complete multipart upload", &res); err != nil {
+		return "", err
+	}
+	return res.ETag, nil
+}
+
+func (p *proxy) abortMultipart(ctx context.Context, bucket, key, uploadID string) error {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, p.uploadURL(bucket, key, url.Values{"uploadId": {uploadID}}), nil)
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("abort multipart upload failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// partSizeFor returns a part size of at least minSize that keeps size bytes
+// within the part count limit.
+func partSizeFor(size, minSize int64) int64 {
+	ps := minSize
+	if n := (size + ps - 1) / ps; n > maxParts {
+		ps = (size + maxParts - 1) / maxParts
+	}
+	return ps
+}
+
+// multipartCopy copies an object too large for CopyObject with ranged
+// UploadPartCopy calls run in parallel. The upload is aborted on failure.
+func (p *proxy) multipartCopy(ctx context.Context, bucket, srcKey, dstKey string, h objectHead) error {
+	id, err := p.createMultipart(ctx, bucket, dstKey, h.Header)
+	if err != nil {
+		return err
+	}
+	ps := partSizeFor(h.Size, copyPartSize)
+	n := int((h.Size + ps - 1) / ps)
+	parts := make([]completedPart, n)
+
+	ctx2, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	ch := make(chan int)
+	for i := 0; i < copyPartWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				first := int64(i) * ps
+				last := min(first+ps, h.Size) - 1
+				var etag string
+				err := withRetry(ctx2, func() (err error) {
+					etag, err = p.uploadPartCopy(ctx2, bucket, dstKey, id, i+1, srcKey, first, last)
+					return err
+				})
+				if err != nil {
+					errOnce.Do(func() { firstErr = err; cancel() })
+					continue
+				}
+				parts[i] = completedPart{PartNumber: i + 1, ETag: etag}
+			}
+		}()
+	}
+	for i := 0; i < n && ctx2.Err() == nil; i++ {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr == nil {
+		_, firstErr = p.completeMultipart(ctx, bucket, dstKey, id, parts)
+	}
+	if firstErr != nil {
+		if err := p.abortMultipart(context.WithoutCancel(ctx), bucket, dstKey, id); err != nil {
+			return fmt.Errorf("%w (abort: %v)", firstErr, err)
+		}
+		return firstErr
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	actRead         = "read"
+	actWrite        = "write"
+	actDelete       = "delete"
+	actDeletePrefix = "delete-prefix"
+)
+
+var knownActions = map[string]bool{
+	actRead:         true,
+	actWrite:        true,
+	actDelete:       true,
+	actDeletePrefix: true,
+}
+
+// policyRule grants Actions on every key starting with Prefix to the listed
+// principals: "*" (anyone), "user:<name>" or "group:<name>". An empty Profile
+// or Bucket matches every profile or bucket.
+type policyRule struct {
+	Principals []string `json:"principals"`
+	Profile    string   `json:"profile,omitempty"`
+	Bucket     string   `json:"bucket,omitempty"`
+	Prefix     string   `json:"prefix"`
+	Actions    []string `json:"actions"`
+}
+
+// policy is deny-by-default: a request is allowed only when a rule grants it.
+// A nil *policy allows everything, which keeps deployments without a policy
+// file working as before.
+type policy struct {
+	Groups map[string][]string `json:"groups"`
+	Rules  []policyRule        `json:"rules"`
+
+	memberOf map[string]map[string]bool
+}
+
+func loadPolicy(p string) (*policy, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var pol policy
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pol); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	if err := pol.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return &pol, nil
+}
+
+func (pol *policy) compile() error {
+	pol.memberOf = map[string]map[string]bool{}
+	for g, users := range pol.Groups {
+		for _, u := range users {
+			if pol.memberOf[u] == nil {
+				pol.memberOf[u] = map[string]bool{}
+			}
+			pol.memberOf[u][g] = true
+		}
+	}
+	for i := range pol.Rules {
+		r := &pol.Rules[i]
+		r.Prefix = strings.TrimLeft(r.Prefix, "/")
+		if len(r.Principals) == 0 {
+			return fmt.Errorf("rule %d: no principals", i)
+		}
+		for _, pr := range r.Principals {
+			kind, name, _ := strings.Cut(pr, ":")
+			switch {
+			case pr == "*":
+			case kind == "user" && name != "":
+			case kind == "group" && name != "":
+				if _, ok := pol.Groups[name]; !ok {
+					return fmt.Errorf("rule %d: unknown group %q", i, name)
+				}
+			default:
+				return fmt.Errorf("rule %d: invalid principal %q", i, pr)
+			}
+		}
+		if len(r.Actions) == 0 {
+			return fmt.Errorf("rule %d: no actions", i)
+		}
+		for _, a := range r.Actions {
+			if !knownActions[a] {
+				return fmt.Errorf("rule %d: unknown action %q", i, a)
+			}
+		}
+	}
+	return nil
+}
+
+// forProfile returns the subset of rules that apply to one backend profile.
+func (pol *policy) forProfile(name string) *policy {
+	if pol == nil {
+		return nil
+	}
+	out := &policy{Groups: pol.Groups, memberOf: pol.memberOf}
+	for _, r := range pol.Rules {
+		if r.Profile == "" || r.Profile == name {
+			out.Rules = append(out.Rules, r)
+		}
+	}
+	return out
+}
+
+func (pol *policy) appliesTo(r policyRule, id *identity) bool {
+	for _, pr := range r.Principals {
+		if pr == "*" {
+			return true
+		}
+		if id == nil {
+			continue
+		}
+		kind, name, _ := strings.Cut(pr, ":")
+		if kind == "user" && name == id.Name {
+			return true
+		}
+		if kind == "group" && pol.memberOf[id.Name][name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r policyRule) coversBucket(bucket string) bool {
+	return r.Bucket == "" || r.Bucket == bucket
+}
+
+func hasAction(r policyRule, action string) bool {
+	for _, a := range r.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether id may perform action on key. For prefix-wide
+// operations pass the prefix itself: the grant must cover the whole subtree.
+func (pol *policy) allowed(id *identity, action, bucket, key string) bool {
+	if pol == nil {
+		return true
+	}
+	key = strings.TrimLeft(key, "/")
+	for _, r := range pol.Rules {
+		if hasAction(r, action) && r.coversBucket(bucket) && strings.HasPrefix(key, r.Prefix) && pol.appliesTo(r, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether id can read at least one key under prefix, which
+// is what decides if a folder shows up in listings.
+func (pol *policy) visible(id *identity, bucket, prefix string) bool {
+	if pol == nil {
+		return true
+	}
+	prefix = strings.TrimLeft(prefix, "/")
+	for _, r := range pol.Rules {
+		if !hasAction(r, actRead) || !r.coversBucket(bucket) || !pol.appliesTo(r, id) {
+			continue
+		}
+		if strings.HasPrefix(prefix, r.Prefix) || strings.HasPrefix(r.Prefix, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxy) authorize(w http.ResponseWriter, r *http.Request, action, bucket, key string) bool {
+	if p.global.ReadOnly && action != actRead {
+		http.Error(w, "read-only mode", http.StatusForbidden)
+		return false
+	}
+	if p.policy.allowed(identityFrom(r.Context()), action, bucket, key) {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("forbidden: %s %s/%s", action, bucket, key), http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func testPolicy(t *testing.T) *policy {
+	t.Helper()
+	pol := &policy{
+		Groups: map[string][]string{"staff": {"alice", "bob"}},
+		Rules: []policyRule{
+			{Principals: []string{"*"}, Prefix: "public/", Actions: []string{actRead}},
+			{Principals: []string{"group:staff"}, Prefix: "team/", Actions: []string{actRead, actWrite}},
+			{Principals: []string{"user:alice"}, Prefix: "/team/archive/", Actions: []string{actDelete, actDeletePrefix}},
+			{Principals: []string{"user:bob"}, Bucket: "logs", Prefix: "", Actions: []string{actRead}},
+		},
+	}
+	if err := pol.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return pol
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	pol := testPolicy(t)
+	alice, bob, eve := &identity{Name: "alice"}, &identity{Name: "bob"}, &identity{Name: "eve"}
+	for _, tc := range []struct {
+		id     *identity
+		action string
+		bucket string
+		key    string
+		want   bool
+	}{
+		{nil, actRead, "data", "public/a.txt", true},
+		{nil, actWrite, "data", "public/a.txt", false},
+		{nil, actRead, "data", "team/a.txt", false},
+		{eve, actRead, "data", "public/a.txt", true},
+		{eve, actRead, "data", "team/a.txt", false},
+		{alice, actRead, "data", "team/a.txt", true},
+		{alice, actWrite, "data", "/team/a.txt", true},
+		{alice, actWrite, "data", "teammate/a.txt", false},
+		{bob, actDelete, "data", "team/archive/a.txt", false},
+		{alice, actDelete, "data", "team/archive/a.txt", true},
+		{alice, actDeletePrefix, "data", "team/", false},
+		{bob, actRead, "logs", "2024/app.log", true},
+		{bob, actRead, "data", "2024/app.log", false},
+		{alice, actRead, "logs", "2024/app.log", false},
+	} {
+		if got := pol.allowed(tc.id, tc.action, tc.bucket, tc.key); got != tc.want {
+			t.Errorf("allowed(%v, %s, %s, %q) = %v, want %v", tc.id, tc.action, tc.bucket, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyVisible(t *testing.T) {
+	pol := testPolicy(t)
+	alice, eve := &identity{Name: "alice"}, &identity{Name: "eve"}
+	for _, tc := range []struct {
+		id     *identity
+		prefix string
+		want   bool
+	}{
+		{eve, "", true},
+		{eve, "public/", true},
+		{eve, "public/sub/", true},
+		{eve, "team/", false},
+		{alice, "team/", true},
+		{alice, "/team/archive/", true},
+		{alice, "other/", false},
+	} {
+		if got := pol.visible(tc.id, "data", tc.prefix); got != tc.want {
+			t.Errorf("visible(%v, %q) = %v, want %v", tc.id, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	var pol *policy
+	if !pol.allowed(nil, actDeletePrefix, "data", "") || !pol.visible(nil, "data", "any/") {
+		t.Error("a nil policy must allow everything")
+	}
+}
+
+func TestPolicyCompileErrors(t *testing.T) {
+	for _, r := range []policyRule{
+		{Prefix: "a/", Actions: []string{actRead}},
+		{Principals: []string{"user:"}, Actions: []string{actRead}},
+		{Principals: []string{"group:nope"}, Actions: []string{actRead}},
+		{Principals: []string{"*"}},
+		{Principals: []string{"*"}, Actions: []string{"admin"}},
+	} {
+		pol := &policy{Rules: []policyRule{r}}
+		if err := pol.compile(); err == nil {
+			t.Errorf("compile(%+v) succeeded, want an error", r)
+		}
+	}
+}
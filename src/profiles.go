@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultProfileName = "default"
+
+var profileNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type profilesFile struct {
+	Default  string                `json:"default"`
+	Profiles map[string]profileCfg `json:"profiles"`
+}
+
+// loadProfilesFile reads the JSON profiles file. ${VAR} references are
+// expanded from the environment so credentials can stay out of the file.
+func loadProfilesFile(p string) (profilesFile, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return profilesFile{}, err
+	}
+	b = []byte(os.ExpandEnv(string(b)))
+
+	var pf profilesFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pf); err != nil {
+		return profilesFile{}, fmt.Errorf("%s: %w", p, err)
+	}
+	if len(pf.Profiles) == 0 {
+		return profilesFile{}, fmt.Errorf("%s: no profiles defined", p)
+	}
+	for name := range pf.Profiles {
+		if !profileNameRe.MatchString(name) {
+			return profilesFile{}, fmt.Errorf("%s: invalid profile name %q", p, name)
+		}
+	}
+	if pf.Default == "" {
+		if _, ok := pf.Profiles[defaultProfileName]; ok {
+			pf.Default = defaultProfileName
+		} else if len(pf.Profiles) == 1 {
+			for name := range pf.Profiles {
+				pf.Default = name
+			}
+		}
+	}
+	if pf.Default == "" {
+		return profilesFile{}, fmt.Errorf("%s: \"default\" is required with several profiles", p)
+	}
+	if _, ok := pf.Profiles[pf.Default]; !ok {
+		return profilesFile{}, fmt.Errorf("%s: default profile %q is not defined", p, pf.Default)
+	}
+	return pf, nil
+}
+
+// registry holds one proxy per named S3 backend. The default profile is
+// served on the top-level routes, every profile on /b/{profile}/...
+type registry struct {
+	profiles map[string]*proxy
+	handlers map[string]http.Handler
+	names    []string
+	def      string
+	auth     *authenticator
+	cfg      cfg
+	handler  http.Handler
+}
+
+func newRegistry(c cfg) (*registry, error) {
+	auth, err := newAuthenticator(c)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	if auth == nil {
+		log.Printf("warning: no AUTH_USERS_FILE or AUTH_TOKENS_FILE set, all routes are public")
+	}
+	var pol *policy
+	if c.PolicyFile != "" {
+		if pol, err = loadPolicy(c.PolicyFile); err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+	}
+
+	g := &registry{profiles: map[string]*proxy{}, handlers: map[string]http.Handler{}, def: c.DefaultProfile, auth: auth, cfg: c}
+	for name := range c.Profiles {
+		p, err := newProxy(name, c, pol)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		g.profiles[name] = p
+		g.handlers[name] = p.routes()
+		g.names = append(g.names, name)
+	}
+	sort.Strings(g.names)
+	if g.profiles[g.def] == nil {
+		return nil, fmt.Errorf("default profile %q is not defined", g.def)
+	}
+	g.handler = g.routes()
+	return g, nil
+}
+
+func (g *registry) handleProfile(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/b/")
+	name, _, _ := strings.Cut(rest, "/")
+	h := g.handlers[name]
+	if h == nil {
+		http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+		return
+	}
+	http.StripPrefix("/b/"+name, h).ServeHTTP(w, r)
+}
+
+type profileJSON struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default,omitempty"`
+}
+
+type profilesResponse struct {
+	Default  string        `json:"default"`
+	Profiles []profileJSON `json:"profiles"`
+}
+
+func (g *registry) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	out := profilesResponse{Default: g.def, Profiles: make([]profileJSON, 0, len(g.names))}
+	for _, name := range g.names {
+		out.Profiles = append(out.Profiles, profileJSON{Name: name, Default: name == g.def})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func (g *registry) routes() http.Handler {
+	mux := http.NewServeMux()
+	def := g.handlers[g.def]
+	mux.Handle("/api/", def)
+	mux.Handle("/s3", def)
+	mux.Handle("/s3/", def)
+	mux.HandleFunc("/b/", g.handleProfile)
+	mux.HandleFunc("/api/profiles", g.handleProfiles)
+	if g.auth != nil {
+		mux.HandleFunc("/api/login", g.auth.handleLogin)
+		mux.HandleFunc("/api/logout", g.auth.handleLogout)
+	}
+
+	publicFS, err := fs.Sub(embeddedPublic, "public")
+	if err != nil {
+		log.Fatalf("embed public: %v", err)
+	}
+	mux.Handle("/", spaFileServerFS(publicFS))
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = ctx
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	if g.auth == nil {
+		return withCORS(mux)
+	}
+	return withCORS(g.auth.middleware(mux))
+}
@@ -7,7 +7,12 @@ const config = {
   trashPrefix: '_trash/',
   keyExcludePatterns: [/^index\.html$/],
   pageSize: 50,
-  defaultOrder: 'name-asc'
+  defaultOrder: 'name-asc',
+  profile: '',
+  bucket: '',
+  readOnly: false,
+  maxUploadSize: 0,
+  features: {}
 };
 window.BB = window.BB || {};
 BB.cfg = config;
@@ -38,19 +43,48 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
   const htmlPrefix = 'HTML>';
   if (config.title) config.titleHTML = config.title.startsWith(htmlPrefix) ? config.title.substring(htmlPrefix.length) : config.title.escapeHTML();
   if (config.subtitle) config.subtitleHTML = config.subtitle.startsWith(htmlPrefix) ? config.subtitle.substring(htmlPrefix.length) : config.subtitle.escapeHTML();
+  config.profile = new URLSearchParams(location.search).get('profile') || localStorage.getItem('bb.profile') || config.profile || '';
+  config.bucket = new URLSearchParams(location.search).get('bucket') || localStorage.getItem('bb.bucket') || config.bucket || '';
+  document.title = config.title || 'Bucket Browser';
+  const fav = document.getElementById('favicon'); if (fav && config.favicon) fav.href = config.favicon;
+  document.documentElement.style.setProperty('--primary-color', config.primaryColor);
+})();
+
+// applyServerConfig merges the /api/config response into BB.cfg.
+function applyServerConfig(sc) {
+  sc = sc || {};
+  if (sc.bucketUrl) config.bucketUrl = sc.bucketUrl;
+  if (sc.bucketMaskUrl) config.bucketMaskUrl = sc.bucketMaskUrl;
+  if (sc.rootPrefix != null) config.rootPrefix = sc.rootPrefix;
+  if (sc.trashPrefix) config.trashPrefix = sc.trashPrefix;
+  config.thumbPrefix = sc.thumbPrefix || '';
+  if (Array.isArray(sc.excludePatterns)) config.keyExcludePatterns = sc.excludePatterns.map(p => new RegExp(p));
+  config.readOnly = !!sc.readOnly;
+  config.maxUploadSize = Number(sc.maxUploadSize) || 0;
+  config.features = sc.features || {};
+  if (sc.features) config.allowDownloadAll = sc.features.downloadAll !== false;
+
   config.bucketUrl = config.bucketUrl || '/s3';
   config.bucketMaskUrl = config.bucketMaskUrl || '/s3';
   config.rootPrefix = (config.rootPrefix || '');
   if (config.rootPrefix) config.rootPrefix = config.rootPrefix.replace(/\/?$/, '/');
-  document.title = config.title || 'Bucket Browser';
-  const fav = document.getElementById('favicon'); if (fav && config.favicon) fav.href = config.favicon;
-  document.documentElement.style.setProperty('--primary-color', config.primaryColor);
   const absTrash = (config.rootPrefix || '') + (config.trashPrefix || '_trash/');
   const rx = new RegExp('^' + absTrash.replace(/[.*+?^${}()|[\]\\]/g, '\\$&'));
   if (!config.keyExcludePatterns.some(r => r.toString() === rx.toString())) config.keyExcludePatterns.push(rx);
-})();
+  if (config.thumbPrefix) {
+    const trx = new RegExp('^' + (config.rootPrefix + config.thumbPrefix).replace(/[.*+?^${}()|[\]\\]/g, '\\$&'));
+    if (!config.keyExcludePatterns.some(r => r.toString() === trx.toString())) config.keyExcludePatterns.push(trx);
+  }
+}
+
+(async function main() {
+  try {
+    applyServerConfig(await BB.api.config());
+  } catch (e) {
+    if (e.status === 401) { location.href = '/login?next=' + encodeURIComponent(location.pathname + location.search + location.hash); return; }
+    applyServerConfig(null);
+  }
 
-(function main() {
   const app = Vue.createApp({
     data() {
       return {
@@ -62,11 +96,11 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         continuationToken: undefined,
         nextContinuationToken: undefined,
         windowWidth: window.innerWidth,
-        downloadAllFilesCount: null,
-        downloadAllFilesReceivedCount: null,
-        downloadAllFilesProgress: null,
         isRefreshing: false,
-        hasFflate: typeof window !== 'undefined' && !!window.fflate,
+        profiles: [],
+        profile: config.profile,
+        buckets: [],
+        bucket: config.bucket,
         pageSize: config.pageSize || 50
       };
     },
@@ -75,9 +109,9 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
       cardView() { return this.windowWidth <= 768; },
       bucketPrefix() { return `${config.rootPrefix}${this.pathPrefix || ''}`; },
       canDownloadAll() {
-        const filesCount = this.pathContentTableData.filter(i => i.type === 'content').length;
-        return this.config.allowDownloadAll && filesCount >= 2;
+        return this.config.allowDownloadAll && this.pathContentTableData.length > 0;
       },
+      canWrite() { return !this.config.readOnly; },
       currentPage() { return (this.previousContinuationTokens?.length || 0) + 1; },
       breadcrumbs() {
         let p = (this.pathPrefix || '').replace(/\/+$/g, '');
@@ -104,6 +138,19 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         this.searchPrefix = pp.replace(/^.*\//, '');
         this.refresh();
       },
+      profile(val) {
+        config.profile = val || '';
+        if (val) localStorage.setItem('bb.profile', val); else localStorage.removeItem('bb.profile');
+        BB.api.config().then(applyServerConfig).catch(() => {}).then(() => this.loadBuckets(true)).then(() => { if (this.pathPrefix) this.goToPrefix(''); else this.refresh(); });
+      },
+      bucket(val) {
+        config.bucket = val || '';
+        if (val) localStorage.setItem('bb.bucket', val); else localStorage.removeItem('bb.bucket');
+        this.previousContinuationTokens = [];
+        this.continuationToken = undefined;
+        this.nextContinuationToken = undefined;
+        if (this.pathPrefix) this.goToPrefix(''); else this.refresh();
+      },
       pageSize() {
         this.config.pageSize = Number(this.pageSize) || 50;
         this.previousContinuationTokens = [];
@@ -113,6 +160,14 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
       }
     },
     methods: {
+      feature(name) { return this.config.features[name] !== false; },
+      async loadBuckets(reset) {
+        try {
+          const res = await BB.api.buckets();
+          this.buckets = (res.buckets || []).map(b => b.name);
+          if (reset || !this.bucket || !this.buckets.includes(this.bucket)) this.bucket = res.default || this.buckets[0] || '';
+        } catch {}
+      },
       blurActiveElement() { if (document.activeElement && document.activeElement.blur) document.activeElement.blur(); },
       manualRefresh() {
         this.previousContinuationTokens = [];
@@ -149,6 +204,12 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         return 'file-outline';
       },
 
+      rowThumbUrl(row) {
+        if (row.type !== 'content' || row.noThumb || (BB.cfg.features || {}).thumbnails === false) return null;
+        if (!['jpg','jpeg','png','gif','webp'].includes(extOf(row.name))) return null;
+        return BB.api.thumbUrl(row.key, 48);
+      },
+
       validBucketPrefix(prefix) {
         if (prefix === '') return true;
         if (prefix.startsWith(' ') || prefix.endsWith(' ')) return false;
@@ -180,7 +241,11 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
       async openPreview(row) {
         const dir = (this.pathPrefix || '').replace(/[^/]*$/, '');
         const base = location.pathname.replace(/[^/]*$/, '') + 'preview';
-        const href = `${base}#${dir}${row.name}`
+        const params = new URLSearchParams();
+        if (config.profile) params.set('profile', config.profile);
+        if (config.bucket) params.set('bucket', config.bucket);
+        const qs = params.toString() ? `?${params}` : '';
+        const href = `${base}${qs}#${dir}${row.name}`
         window.open(href, '_blank', 'noopener,noreferrer');
         return;
       },
@@ -248,12 +313,19 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
           if (BB.cfg.trashPrefix) {
             url += `&exclude=${encodeURIComponent(BB.cfg.trashPrefix)}`;
           }
+          if (BB.cfg.thumbPrefix) {
+            url += `&exclude=${encodeURIComponent(BB.cfg.thumbPrefix)}`;
+          }
 
           if (this.continuationToken) {
             url += `&continuationToken=${encodeURIComponent(this.continuationToken)}`;
           }
 
-          const resp = await fetch(url);
+          const resp = await fetch(BB.api.withBucket(BB.api.apiUrl(url)));
+          if (resp.status === 401) {
+            window.location.href = '/login?next=' + encodeURIComponent(location.pathname + location.hash);
+            return;
+          }
           if (!resp.ok) throw new Error(`HTTP ${resp.status}`);
           const data = await resp.json();
 
@@ -271,9 +343,9 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
               };
             } else {
               const key = it.key || '';
-              const url = `${(BB.cfg.bucketUrl || '/s3').replace(/\/*$/, '')}/${BB.detect.encodePath(key)}`;
+              const url = BB.api.urlForKey(key);
               let installUrl;
-              if (url.endsWith('/manifest.plist') && (navigator.platform === 'MacIntel' && navigator.maxTouchPoints > 1)) {
+              if (url.split('?')[0].endsWith('/manifest.plist') && (navigator.platform === 'MacIntel' && navigator.maxTouchPoints > 1)) {
                 installUrl = `itms-services://?action=download-manifest&url=${BB.detect.encodePath(url)}`;
               }
               return {
@@ -336,17 +408,29 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         await this.refresh();
       },
       async uploadFiles(files, keyResolver) {
-        const base = (config.bucketUrl || '/s3').replace(/\/*$/, '');
+        const base = BB.api.apiUrl((config.bucketUrl || '/s3').replace(/\/*$/, ''));
         const concurrency = 5;
+        const multipartThreshold = 64 * 1048576;
+        const max = config.maxUploadSize || 0;
+        const tooLarge = max ? files.filter(f => f.size > max) : [];
+        if (tooLarge.length) {
+          BB.ui.toast(`Skipped ${tooLarge.length} file(s) larger than ${(max / 1048576).toFixed(0)} MB`);
+          files = files.filter(f => !tooLarge.includes(f));
+          if (!files.length) return;
+        }
         const queue = files.slice();
         const runOne = async () => {
           const f = queue.shift(); if (!f) return;
           const rel = keyResolver(f);
           const key = (this.bucketPrefix + rel).replace(/\/{2,}/g, '/');
-          const putURL = `${base}/${encodePath(key)}`;
+          const putURL = BB.api.withBucket(`${base}/${encodePath(key)}`);
           try {
-            const res = await fetch(putURL, { method: 'PUT', headers: { 'Content-Type': f.type || 'application/octet-stream' }, body: f });
-            if (!res.ok) { const txt = await res.text().catch(()=>''); throw new Error(`HTTP ${res.status}${txt ? ' – ' + txt : ''}`); }
+            if (f.size > multipartThreshold) {
+              await BB.api.multipartUpload(key, f);
+            } else {
+              const res = await fetch(putURL, { method: 'PUT', headers: { 'Content-Type': f.type || 'application/octet-stream' }, body: f });
+              if (!res.ok) { const txt = await res.text().catch(()=>''); throw new Error(`HTTP ${res.status}${txt ? ' – ' + txt : ''}`); }
+            }
           } catch (e) { BB.ui.toast(`Upload failed: ${rel} — ${e}`); }
           if (queue.length) await runOne();
         };
@@ -354,53 +438,20 @@ function langFromExt(e){ return BB.detect.langFromExt(e); }
         BB.ui.toast(`Upload done (${files.length})`);
       },
 
-      async downloadAllFiles() {
-        if (!window.fflate || !window.fflate.Zip || !window.fflate.ZipPassThrough) { BB.ui.toast('Archive not available (fflate not loaded).'); return; }
-        const { Zip, ZipPassThrough } = window.fflate;
-        const archiveFiles = this.pathContentTableData.filter(i => i.type === 'content').map(i => i.url);
-        if (!archiveFiles.length) { BB.ui.toast('No file to download'); return; }
-        this.downloadAllFilesCount = archiveFiles.length;
-        this.downloadAllFilesReceivedCount = 0;
-        this.downloadAllFilesProgress = 0;
-
-        let totalContentLength = 0, totalReceivedLength = 0;
-        const archiveName = (this.pathPrefix || '').split('/').filter(p => p.trim()).pop();
-        const archiveData = [];
-        const archive = new Zip((err, data) => { if (err) throw err; archiveData.push(data); });
-
-        await Promise.all(archiveFiles.map(async (url) => {
-          const fileName = url.split('/').filter(p => p.trim()).pop();
-          const fileStream = new ZipPassThrough(fileName);
-          archive.add(fileStream);
-
-          const resp = await fetch(url);
-          const len = parseInt(resp.headers.get('Content-Length') || '0', 10);
-          if (!isNaN(len)) totalContentLength += len;
-
-          const reader = resp.body.getReader();
-          while (true) {
-            const { done, value } = await reader.read();
-            if (done) { fileStream.push(new Uint8Array(), true); break; }
-            fileStream.push(new Uint8Array(value));
-            totalReceivedLength += value.length;
-            const p1 = totalContentLength ? (totalReceivedLength / totalContentLength) : 0;
-            const p2 = this.downloadAllFilesCount ? (this.downloadAllFilesReceivedCount / this.downloadAllFilesCount) : 0;
-            this.downloadAllFilesProgress = (p1 + p2) / 2;
-          }
-          this.downloadAllFilesReceivedCount++;
-        })).then(() => archive.end());
-
-        const blob = new Blob(archiveData, { type: 'application/zip' });
-        const href = URL.createObjectURL(blob);
+      // downloadAllFiles lets the server stream the folder as a ZIP, so that
+      // large folders never have to fit in the browser's memory.
+      downloadAllFiles() {
         const a = document.createElement('a');
-        a.href = href; a.download = `${archiveName || 'archive'}.zip`; a.click();
-        URL.revokeObjectURL(href);
-
-        this.downloadAllFilesCount = this.downloadAllFilesReceivedCount = this.downloadAllFilesProgress = null;
+        a.href = BB.api.archiveUrl(this.bucketPrefix);
+        a.click();
       }
     },
     mounted() {
-      this.hasFflate = !!(window && window.fflate);
+      BB.api.profiles().then(res => {
+        this.profiles = (res.profiles || []).map(p => p.name);
+        if (this.profile && !this.profiles.includes(this.profile)) this.profile = '';
+        else this.loadBuckets(false);
+      }).catch(() => this.loadBuckets(false));
       window.addEventListener('hashchange', this.updatePathFromHash);
       window.addEventListener('resize', () => { this.windowWidth = window.innerWidth; });
       this.updatePathFromHash();
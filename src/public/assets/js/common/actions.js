@@ -23,7 +23,10 @@
     deletePrompt: 'Delete this fichier ?',
     folderDeletePrompt: 'Delete this folder and all it\'s content?',
     deleteOk: 'Deleted.',
+    deleteKo: 'Delete failed.',
     renameOk: 'Renamed.',
+    renameRollbackPrompt: 'Move the objects already renamed back to the original folder?',
+    renameRolledBack: 'Rename rolled back.',
     moveTrashOk: 'Moved to the trash',
     unauthorized: 'Unauthorized',
     copyDenied: 'Copy refused'
@@ -147,7 +150,6 @@
     p = (p||'').replace(/\/{2,}/g,'/').replace(/^\//,'');
     return p.endsWith('/') ? p : (p + '/');
   }
-  function escapeRx(s){ return s.replace(/[.*+?^${}()|[\]\\]/g,'\\$&'); }
 
   async function showPrefixDetails(prefixAbs) {
   const ui = getUI();
@@ -289,7 +291,21 @@
     if (!newName || newName === last) return false;
     const dst = ensurePrefix(parent + newName);
     try {
-      await BB.api.rename({ src: p, dst, isPrefix: true });
+      let res = await BB.api.rename({ src: p, dst, isPrefix: true });
+      while (res.failed && res.failed.length) {
+        const first = res.failed[0];
+        const msg = `${res.failed.length} object(s) could not be moved (first: ${first.key} — ${first.error}). Retry the remaining ones?`;
+        if (await ui.confirm({ title: labels.renameTitle, message: msg })) {
+          res = await BB.api.renameResume(res.id);
+          continue;
+        }
+        if (await ui.confirm({ title: labels.renameTitle, message: labels.renameRollbackPrompt })) {
+          await BB.api.renameRollback(res.id);
+          ui.toast(labels.renameRolledBack);
+          return false;
+        }
+        return dst;
+      }
       ui.toast(labels.renameOk);
       return dst;
     } catch (e) {
@@ -308,22 +324,13 @@
     const dst = ensurePrefix(parent + '/' + newName);
 
     try {
-      const keys = await BB.api.listAll(src);
-      const rx = new RegExp('^' + escapeRx(src));
-      const toCopy = keys.filter(k => !k.endsWith('/'));
-      const concurrency = 8;
-      let done = 0;
-      const queue = toCopy.slice();
-      const runOne = async () => {
-        const k = queue.shift(); if (!k) return;
-        const rel = k.replace(rx, '');
-        const out = dst + rel;
-        try { await BB.api.copy(k, out); } catch (e) { console.error('Copy fail', k, '->', out, e); }
-        done++;
-        if (queue.length) await runOne();
-      };
-      await Promise.all(Array.from({length: Math.min(concurrency, queue.length)}, runOne));
-      ui.toast(`Folder copy done (${done} objects)`);
+      const { copied, failed } = await BB.api.copyPrefix(src, dst);
+      if (failed.length) {
+        const list = failed.slice(0, 20).map(e => `<li><code>${escapeHTML(e.key)}</code> — ${escapeHTML(e.error)}</li>`).join('');
+        await ui.alert({ title: 'Copy the folder', html: `<p>Copied ${copied} objects, ${failed.length} failed:</p><ul>${list}</ul>` });
+        return dst;
+      }
+      ui.toast(`Folder copy done (${copied} objects)`);
       return dst;
     } catch (e) {
       await ui.alert({ title: 'Copy the folder', message: String(e) });
@@ -336,7 +343,17 @@
     const okc = await ui.confirm({ title: labels.deleteTitle, message: labels.folderDeletePrompt });
     if (!okc) return false;
     try {
-      const { deleted } = await BB.api.deletePrefix(ensurePrefix(prefixAbs));
+      if (trashEnabled()) {
+        const { moved } = await BB.api.trash({ key: ensurePrefix(prefixAbs), isPrefix: true });
+        ui.toast(`${labels.moveTrashOk} (${moved} objects)`);
+        return 'trash';
+      }
+      const { deleted, failed, errors } = await BB.api.deletePrefix(ensurePrefix(prefixAbs));
+      if (failed) {
+        const list = (errors || []).slice(0, 20).map(e => `<li><code>${escapeHTML(e.key)}</code> — ${escapeHTML(e.error)}</li>`).join('');
+        await ui.alert({ title: labels.deleteTitle, html: `<p>Deleted ${deleted} objects, ${failed} failed:</p><ul>${list}</ul>` });
+        return true;
+      }
       ui.toast(`Deleted (${deleted} objects)`);
       return true;
     } catch (e) {
@@ -385,24 +402,55 @@
     }
   }
 
+  async function extractArchive(absKey) {
+    const ui = getUI();
+    const name = absKey.split('/').pop() || absKey;
+    const folder = name.replace(/\.(zip|tar|tgz|tar\.(gz|zst|bz2))$/i, '');
+    const newName = await ui.prompt({ title: `Extract ${name}`, message: 'Folder to extract into (existing files are kept)', defaultValue: folder });
+    if (!newName) return false;
+    const dst = ensurePrefix(dirOf(absKey) + newName);
+    try {
+      const { extracted, skipped, failed, entries } = await BB.api.extract(absKey, dst, 'skip');
+      if (failed) {
+        const list = entries.filter(e => e.status === 'failed').slice(0, 20).map(e => `<li><code>${escapeHTML(e.entry)}</code> — ${escapeHTML(e.error)}</li>`).join('');
+        await ui.alert({ title: `Extract ${name}`, html: `<p>Extracted ${extracted} files, ${skipped} skipped, ${failed} failed:</p><ul>${list}</ul>` });
+        return dst;
+      }
+      ui.toast(`Extracted ${extracted} files${skipped ? `, ${skipped} skipped` : ''}`);
+      return dst;
+    } catch (e) {
+      await ui.alert({ title: `Extract ${name}`, message: String(e) });
+      return false;
+    }
+  }
+
   async function deleteObject(absKey) {
     const ui = getUI();
     const okc = await ui.confirm({ title: labels.deleteTitle, message: labels.deletePrompt, confirmText: 'Supprimer' });
     if (!okc) return false;
+    if (trashEnabled()) {
+      try {
+        await moveToTrash(absKey);
+        ui.toast(labels.moveTrashOk);
+        return 'trash';
+      } catch (e) {
+        await ui.alert({ title: labels.deleteTitle, message: String(e) });
+        return false;
+      }
+    }
     const ok = await BB.api.del(absKey);
     if (!ok) {
-      await moveToTrash(absKey);
-      ui.toast(labels.moveTrashOk);
-      return 'trash';
+      await ui.alert({ title: labels.deleteTitle, message: labels.deleteKo });
+      return false;
     }
     ui.toast(labels.deleteOk);
     return true;
   }
 
+  function trashEnabled() { return !(BB.cfg.features && BB.cfg.features.trash === false); }
+
   async function moveToTrash(absKey) {
-    const ts = new Date().toISOString().replace(/[:.]/g,'-');
-    const dst = (BB.cfg.trashPrefix || '_trash/') + ts + '/' + absKey;
-    await BB.api.copy(absKey, dst);
+    return await BB.api.trash({ key: absKey, isPrefix: false });
   }
 
   function downloadObject(absKey, filename) {
@@ -421,7 +469,7 @@
     showMetadata, 
     showFileDetails,
     showPrefixDetails, 
-    renameObject, copyObject, deleteObject, downloadObject, moveToTrash,
+    renameObject, copyObject, deleteObject, downloadObject, moveToTrash, extractArchive,
     renamePrefix, copyPrefix, deletePrefix
   };
 })();
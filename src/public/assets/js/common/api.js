@@ -7,10 +7,18 @@
   if (!BB.detect) throw new Error("BB.detect is required before BB.api");
 
   const api = {
+    apiUrl(path) {
+      if (!BB.cfg.profile || !String(path).startsWith('/')) return path;
+      return `/b/${encodeURIComponent(BB.cfg.profile)}${path}`;
+    },
+    withBucket(url) {
+      if (!BB.cfg.bucket) return url;
+      return url + (url.includes('?') ? '&' : '?') + 'bucket=' + encodeURIComponent(BB.cfg.bucket);
+    },
     urlForKey(key, { mask = false } = {}) {
-      const base = (mask ? (BB.cfg.bucketMaskUrl || BB.cfg.bucketUrl) : BB.cfg.bucketUrl || '/s3').replace(/\/*$/, '');
+      const base = this.apiUrl((mask ? (BB.cfg.bucketMaskUrl || BB.cfg.bucketUrl) : BB.cfg.bucketUrl || '/s3').replace(/\/*$/, ''));
       key = (key || '').replace(/^\//, '');
-      return `${base}/${BB.detect.encodePath(key)}`;
+      return this.withBucket(`${base}/${BB.detect.encodePath(key)}`);
     },
     async head(key) {
       const res = await fetch(this.urlForKey(key), { method: 'HEAD' });
@@ -36,9 +44,82 @@
       const res = await fetch(this.urlForKey(key), { method: 'PUT', headers: { 'Content-Type': mime || 'application/octet-stream' }, body: blob });
       if (!res.ok) throw new Error(`PUT ${res.status}`);
     },
+    archiveUrl(prefix, format = 'zip') {
+      prefix = (prefix || '').replace(/^\//, '');
+      return this.withBucket(this.apiUrl(`/api/archive?prefix=${encodeURIComponent(prefix)}&format=${encodeURIComponent(format)}`));
+    },
+    async archiveEntries(key) {
+      const res = await fetch(this.withBucket(this.apiUrl(`/api/archive-entries?key=${encodeURIComponent((key || '').replace(/^\//, ''))}`)));
+      if (!res.ok) throw new Error(`ENTRIES ${res.status}`);
+      return await res.json();
+    },
+    archiveEntryUrl(key, entry) {
+      key = (key || '').replace(/^\//, '');
+      return this.withBucket(this.apiUrl(`/api/archive-entry?key=${encodeURIComponent(key)}&entry=${encodeURIComponent(entry)}`));
+    },
+    thumbUrl(key, w = 64, h = w) {
+      key = (key || '').replace(/^\//, '');
+      return this.withBucket(this.apiUrl(`/api/thumb?key=${encodeURIComponent(key)}&w=${w}&h=${h}`));
+    },
+    async extract(key, dst, overwrite, onProgress) {
+      return await this.runJob('/api/extract', { bucket: BB.cfg.bucket || undefined, key, dst, overwrite }, onProgress);
+    },
     async copy(srcKey, dstKey) {
-      const blob = await this.getBlob(srcKey);
-      await this.putBlob(dstKey, blob, blob.type || 'application/octet-stream');
+      const res = await fetch(this.apiUrl('/api/copy'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ bucket: BB.cfg.bucket || undefined, src: srcKey, dst: dstKey })
+      });
+      if (!res.ok) throw new Error(`COPY ${res.status}`);
+      return await res.json();
+    },
+    async copyPrefix(srcPrefix, dstPrefix, onProgress) {
+      return await this.runJob('/api/copy', { bucket: BB.cfg.bucket || undefined, src: srcPrefix, dst: dstPrefix, isPrefix: true }, onProgress);
+    },
+    async multipartPost(path, body) {
+      const res = await fetch(this.apiUrl(path), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ bucket: BB.cfg.bucket || undefined, ...body })
+      });
+      if (!res.ok) throw new Error(`${path} ${res.status}${await res.text().then(t => t ? ' – ' + t.trim() : '').catch(() => '')}`);
+      return res.status === 204 ? null : await res.json();
+    },
+    // multipartUpload sends a large file in parallel parts, retrying each
+    // part on its own; the upload is aborted if a part keeps failing.
+    async multipartUpload(key, file, { concurrency = 4, retries = 3, onProgress } = {}) {
+      key = (key || '').replace(/^\//, '');
+      const { uploadId, partSize } = await this.multipartPost('/api/multipart/initiate', { key, contentType: file.type || 'application/octet-stream', size: file.size });
+      const count = Math.max(1, Math.ceil(file.size / partSize));
+      const queue = Array.from({ length: count }, (_, i) => i + 1);
+      const parts = [];
+      let sent = 0;
+      const sendPart = async (n) => {
+        const chunk = file.slice((n - 1) * partSize, Math.min(n * partSize, file.size));
+        const url = this.withBucket(this.apiUrl(`/api/multipart/part?key=${encodeURIComponent(key)}&uploadId=${encodeURIComponent(uploadId)}&partNumber=${n}`));
+        for (let attempt = 0; ; attempt++) {
+          try {
+            const res = await fetch(url, { method: 'PUT', body: chunk });
+            if (!res.ok) throw new Error(`PART ${n} ${res.status}`);
+            parts.push(await res.json());
+            sent += chunk.size;
+            if (onProgress) onProgress(sent, file.size);
+            return;
+          } catch (e) {
+            if (attempt >= retries) throw e;
+            await new Promise(r => setTimeout(r, 500 * 2 ** attempt));
+          }
+        }
+      };
+      const worker = async () => { for (let n; (n = queue.shift());) await sendPart(n); };
+      try {
+        await Promise.all(Array.from({ length: Math.min(concurrency, count) }, worker));
+      } catch (e) {
+        queue.length = 0;
+        await this.multipartPost('/api/multipart/abort', { key, uploadId }).catch(() => {});
+        throw e;
+      }
+      return await this.multipartPost('/api/multipart/complete', { key, uploadId, parts });
     },
     async del(key) {
       try {
@@ -52,9 +133,9 @@
       const out = [];
       let token;
       do {
-        let url = `${BB.cfg.bucketUrl}?list-type=2&prefix=${BB.detect.encodePath(prefixAbs)}`;
+        let url = `${this.apiUrl(BB.cfg.bucketUrl)}?list-type=2&prefix=${BB.detect.encodePath(prefixAbs)}`;
         if (token) url += `&continuation-token=${BB.detect.encodePath(token)}`;
-        const resp = await fetch(url);
+        const resp = await fetch(this.withBucket(url));
         const xml = await resp.text();
         const doc = new DOMParser().parseFromString(xml, 'text/xml');
         const contents = [...doc.querySelectorAll('ListBucketResult > Contents > Key')].map(n => n.textContent);
@@ -63,29 +144,115 @@
       } while (token);
       return out;
     },
-    async rename({ src, dst, isPrefix }) {
-      const res = await fetch('/api/rename', {
+    async rename({ src, dst, isPrefix }, onProgress) {
+      const body = { bucket: BB.cfg.bucket || undefined, src, dst, isPrefix: !!isPrefix };
+      if (isPrefix) return await this.runJob('/api/rename', body, onProgress);
+      const res = await fetch(this.apiUrl('/api/rename'), {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ src, dst, isPrefix: !!isPrefix })
+        body: JSON.stringify(body)
       });
       if (!res.ok) throw new Error(`RENAME ${res.status}`);
       return await res.json();
     },
-    async deletePrefix(prefixAbs) {
-      const res = await fetch('/api/delete-prefix', {
+    async renameResume(id) {
+      const res = await fetch(this.apiUrl('/api/rename/resume'), {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ prefix: prefixAbs })
+        body: JSON.stringify({ id })
       });
-      if (!res.ok) throw new Error(`DELETE-PREFIX ${res.status}`);
+      if (!res.ok) throw new Error(`RENAME-RESUME ${res.status}`);
+      return await res.json();
+    },
+    async renameRollback(id) {
+      const res = await fetch(this.apiUrl('/api/rename/rollback'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+      });
+      if (!res.ok) throw new Error(`RENAME-ROLLBACK ${res.status}`);
+      return await res.json();
+    },
+    async deletePrefix(prefixAbs, onProgress) {
+      return await this.runJob('/api/delete-prefix', { bucket: BB.cfg.bucket || undefined, prefix: prefixAbs }, onProgress);
+    },
+    // runJob starts a background job and polls it until it finishes, so the
+    // operation keeps going on the server if the tab is closed.
+    async runJob(path, body, onProgress) {
+      const res = await fetch(this.apiUrl(path), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ ...body, async: true })
+      });
+      if (!res.ok) throw new Error(`${path} ${res.status}`);
+      let job = await res.json();
+      while (job.state === 'running') {
+        if (onProgress) onProgress(job);
+        await new Promise(r => setTimeout(r, 500));
+        job = await this.job(job.id);
+      }
+      if (onProgress) onProgress(job);
+      if (job.state !== 'done') throw new Error(`${path}: ${job.error || job.state}`);
+      return job.result;
+    },
+    async job(id) {
+      const res = await fetch(this.apiUrl(`/api/jobs/${encodeURIComponent(id)}`));
+      if (!res.ok) throw new Error(`JOB ${res.status}`);
+      return await res.json();
+    },
+    async jobs() {
+      const res = await fetch(this.apiUrl('/api/jobs'));
+      if (!res.ok) throw new Error(`JOBS ${res.status}`);
+      return await res.json();
+    },
+    async cancelJob(id) {
+      const res = await fetch(this.apiUrl(`/api/jobs/${encodeURIComponent(id)}`), { method: 'DELETE' });
+      if (!res.ok) throw new Error(`JOB-CANCEL ${res.status}`);
+      return await res.json();
+    },
+    async trash({ key, isPrefix }) {
+      const res = await fetch(this.apiUrl('/api/trash'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ bucket: BB.cfg.bucket || undefined, key, isPrefix: !!isPrefix })
+      });
+      if (!res.ok) throw new Error(`TRASH ${res.status}${await res.text().then(t => t ? ' – ' + t.trim() : '').catch(() => '')}`);
+      return await res.json();
+    },
+    async trashList() {
+      const res = await fetch(this.withBucket(this.apiUrl('/api/trash/list')));
+      if (!res.ok) throw new Error(`TRASH-LIST ${res.status}`);
+      return await res.json();
+    },
+    async trashRestore(id, { overwrite = false } = {}) {
+      const res = await fetch(this.apiUrl('/api/trash/restore'), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ bucket: BB.cfg.bucket || undefined, id, overwrite })
+      });
+      if (!res.ok) throw new Error(`RESTORE ${res.status}`);
       return await res.json();
     },
     async stats(prefixAbs = '') {
       const p = String(prefixAbs || '').replace(/^\/+/, '');
-      const res = await fetch(`/api/stats?prefix=${encodeURIComponent(p)}`);
+      const res = await fetch(this.withBucket(this.apiUrl(`/api/stats?prefix=${encodeURIComponent(p)}`)));
       if (!res.ok) throw new Error(`STATS ${res.status}`);
       return await res.json();
+    },
+    async buckets() {
+      const res = await fetch(this.apiUrl('/api/buckets'));
+      if (!res.ok) throw new Error(`BUCKETS ${res.status}`);
+      return await res.json();
+    },
+    async config() {
+      const res = await fetch(this.apiUrl('/api/config'));
+      if (!res.ok) { const err = new Error(`CONFIG ${res.status}`); err.status = res.status; throw err; }
+      return await res.json();
+    },
+    async profiles() {
+      const res = await fetch('/api/profiles');
+      if (!res.ok) throw new Error(`PROFILES ${res.status}`);
+      return await res.json();
     }
   };
 
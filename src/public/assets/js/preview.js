@@ -1,6 +1,8 @@
 const CONFIG = { bucketUrl: '/s3', bucketMaskUrl: '/s3', rootPrefix: '', trashPrefix: '_trash/' };
 window.BB = window.BB || {};
 BB.cfg = CONFIG;
+CONFIG.bucket = new URLSearchParams(location.search).get('bucket') || '';
+CONFIG.profile = new URLSearchParams(location.search).get('profile') || '';
 
 function currentKey() {
   const raw = decodeURIComponent((location.hash||'#').slice(1));
@@ -30,6 +32,27 @@ function renderImage(url) { const img = document.createElement('img'); img.src =
 function renderVideo(url) { const v = document.createElement('video'); v.src = url; v.controls = true; v.style.maxWidth = '100%'; return v; }
 function renderAudio(url) { const a = document.createElement('audio'); a.src = url; a.controls = true; a.style.width = '100%'; return a; }
 function renderIframe(url) { const f = document.createElement('iframe'); f.src = url; f.allowFullscreen = true; return f; }
+async function renderArchive(key) {
+  const div = document.createElement('div');
+  let res;
+  try { res = await BB.api.archiveEntries(key); } catch (e) { return renderUnknownBinary(); }
+  const files = res.entries.filter(e => !e.dir);
+  const p = document.createElement('p');
+  p.textContent = `${files.length}${res.truncated ? '+' : ''} file(s) in this ${res.format} archive`;
+  div.appendChild(p);
+  const ul = document.createElement('ul');
+  for (const e of files) {
+    const li = document.createElement('li');
+    const a = document.createElement('a');
+    a.href = BB.api.archiveEntryUrl(key, e.name); a.target = '_blank'; a.rel = 'noopener';
+    a.textContent = e.name;
+    li.appendChild(a);
+    li.appendChild(document.createTextNode(` (${formatBytes(e.size)})`));
+    ul.appendChild(li);
+  }
+  div.appendChild(ul);
+  return div;
+}
 function renderUnknownBinary() {
   const div = document.createElement('div');
   div.innerHTML = `<p><strong>File not available for preview</strong></p><p>You can download the file to access it.</p>`;
@@ -65,6 +88,9 @@ async function render() {
     container.appendChild(renderCode(text, lang));
     return;
   }
+  const extractBtn = document.getElementById('pv-extract');
+  if (extractBtn) extractBtn.style.display = type === 'archive' ? '' : 'none';
+  if (type === 'archive') { container.appendChild(await renderArchive(key)); return; }
   container.appendChild(renderUnknownBinary());
 }
 
@@ -87,6 +113,7 @@ document.getElementById('pv-rename').addEventListener('click', async () => {
     await render();
   }
 });
+document.getElementById('pv-extract').addEventListener('click', () => BB.actions.extractArchive(currentKey()));
 document.getElementById('pv-details').addEventListener('click', () => BB.actions.showMetadata(currentKey()));
 document.getElementById('pv-delete').addEventListener('click', async () => {
   const result = await BB.actions.deleteObject(currentKey());
@@ -94,4 +121,8 @@ document.getElementById('pv-delete').addEventListener('click', async () => {
 });
 
 window.addEventListener('hashchange', render);
-render();
+BB.api.config().then(sc => {
+  ['bucketUrl', 'bucketMaskUrl', 'rootPrefix', 'trashPrefix'].forEach(k => { if (sc[k] != null && sc[k] !== '') CONFIG[k] = sc[k]; });
+  CONFIG.readOnly = !!sc.readOnly;
+  if (CONFIG.readOnly) ['pv-copy', 'pv-rename', 'pv-extract', 'pv-delete'].forEach(id => { const el = document.getElementById(id); if (el) el.remove(); });
+}).catch(() => {}).then(render);
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	renameWorkers    = 8
+	maxRenameWorkers = 32
+	renameAttempts   = 4
+	renameBackoff    = 200 * time.Millisecond
+	renameJournalTTL = 7 * 24 * time.Hour
+	// renameJournalBatch is how many keys are moved between two saves of
+	// the journal, which bounds what a crash can leave unrecorded.
+	renameJournalBatch  = 500
+	renameStatusRunning = "running"
+	renameStatusDone    = "done"
+	renameStatusPartly  = "partial"
+	renameStatusUndone  = "rolled-back"
+)
+
+// renameJournal records a prefix move so that it can be resumed or rolled
+// back later. Moved holds the keys relative to Src that now live under Dst.
+type renameJournal struct {
+	ID      string     `json:"id"`
+	Profile string     `json:"profile"`
+	Bucket  string     `json:"bucket"`
+	Src     string     `json:"src"`
+	Dst     string     `json:"dst"`
+	Status  string     `json:"status"`
+	Moved   []string   `json:"moved"`
+	Failed  []keyError `json:"failed,omitempty"`
+	Started time.Time  `json:"started"`
+	Updated time.Time  `json:"updated"`
+}
+
+func newJournalID() string {
+	b := make([]byte, 8)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validJournalID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (p *proxy) journalPath(id string) string {
+	return filepath.Join(p.global.StateDir, "renames", id+".json")
+}
+
+func (p *proxy) saveJournal(j *renameJournal) error {
+	j.Updated = time.Now().UTC()
+	dir := filepath.Dir(p.journalPath(j.ID))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := p.journalPath(j.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	pruneJournals(dir)
+	return os.Rename(tmp, p.journalPath(j.ID))
+}
+
+func pruneJournals(dir string) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range ents {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > renameJournalTTL {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+func (p *proxy) loadJournal(id string) (*renameJournal, error) {
+	if !validJournalID(id) {
+		return nil, errNotFound
+	}
+	b, err := os.ReadFile(p.journalPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var j renameJournal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, err
+	}
+	if j.Profile != p.name {
+		return nil, errNotFound
+	}
+	return &j, nil
+}
+
+// withRetry runs fn up to renameAttempts times with jittered exponential
+// backoff between attempts. Missing objects are not retried.
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := renameBackoff
+	var err error
+	for i := 0; i < renameAttempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if errors.Is(err, errNotFound) || i == renameAttempts-1 {
+			break
+		}
+		t := time.NewTimer(delay + time.Duration(rand.Int64N(int64(delay))))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+	return err
+}
+
+// moveKeys moves from+rel to to+rel for every rel with a bounded worker pool.
+// It returns the rel names that were moved and the failures, by source key.
+func (p *proxy) moveKeys(ctx context.Context, bucket, from, to string, rels []string, sizes map[string]int64, workers int) ([]string, []keyError) {
+	return p.eachKey(ctx, from, to, rels, sizes, workers, func(src, dst string) error {
+		if err := withRetry(ctx, func() error { return p.copyObject(ctx, bucket, src, dst) }); err != nil {
+			return fmt.Errorf("copy: %w", err)
+		}
+		if err := withRetry(ctx, func() error { return p.deleteObject(ctx, bucket, src) }); err != nil {
+			return fmt.Errorf("copied but source not deleted: %w", err)
+		}
+		return nil
+	})
+}
+
+// eachKey runs fn(from+rel, to+rel) for every rel with a bounded worker pool
+// and reports each key to the progress reporter of ctx.
+func (p *proxy) eachKey(ctx context.Context, from, to string, rels []string, sizes map[string]int64, workers int, fn func(src, dst string) error) ([]string, []keyError) {
+	pr := progressFrom(ctx)
+	var (
+		mu     sync.Mutex
+		done   []string
+		failed []keyError
+		wg     sync.WaitGroup
+	)
+	ch := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range ch {
+				src, dst := from+rel, to+rel
+				if ctx.Err() != nil {
+					mu.Lock()
+					failed = append(failed, keyError{Key: src, Error: ctx.Err().Error()})
+					mu.Unlock()
+					continue
+				}
+				err := fn(src, dst)
+				pr.step(src, sizes[rel], err)
+				mu.Lock()
+				if err != nil {
+					failed = append(failed, keyError{Key: src, Error: err.Error()})
+				} else {
+					done = append(done, rel)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, rel := range rels {
+		ch <- rel
+	}
+	close(ch)
+	wg.Wait()
+	return done, failed
+}
+
+// pendingRels lists the objects left under src, relative to src, with their
+// sizes, and announces them to the progress reporter.
+func (p *proxy) pendingRels(ctx context.Context, bucket, src string) ([]string, map[string]int64, error) {
+	objs, err := p.listAllObjects(ctx, bucket, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	rels := make([]string, 0, len(objs))
+	sizes := make(map[string]int64, len(objs))
+	var total int64
+	for _, o := range objs {
+		if strings.HasSuffix(o.Key, "/") || p.skipThumb(src, o.Key) {
+			continue
+		}
+		rel := strings.TrimPrefix(o.Key, src)
+		rels = append(rels, rel)
+		sizes[rel] = o.Size
+		total += o.Size
+	}
+	progressFrom(ctx).addTotal(len(rels), total)
+	return rels, sizes, nil
+}
+
+// moveJournaled moves rels from j.Src to j.Dst in batches, saving the
+// journal after every batch, so that a process killed in the middle leaves
+// something to resume or roll back from. j must already be on disk. Keys
+// the upload rules refuse at the destination fail without being moved.
+func (p *proxy) moveJournaled(ctx context.Context, j *renameJournal, rels []string, sizes map[string]int64, workers int) ([]string, error) {
+	j.Status, j.Failed = renameStatusRunning, nil
+	rels, j.Failed = p.checkDestinations(ctx, j.Bucket, j.Src, j.Dst, rels, sizes)
+	var moved []string
+	for len(rels) > 0 {
+		n := min(len(rels), renameJournalBatch)
+		m, failed := p.moveKeys(ctx, j.Bucket, j.Src, j.Dst, rels[:n], sizes, workers)
+		rels = rels[n:]
+		moved = append(moved, m...)
+		j.Moved = append(j.Moved, m...)
+		j.Failed = append(j.Failed, failed...)
+		if len(rels) == 0 {
+			break
+		}
+		if err := p.saveJournal(j); err != nil {
+			j.Status = renameStatusPartly
+			return moved, err
+		}
+	}
+	j.Status = renameStatusDone
+	if len(j.Failed) > 0 {
+		j.Status = renameStatusPartly
+	}
+	return moved, p.saveJournal(j)
+}
+
+func (j *renameJournal) response(succeeded []string, start time.Time) renameResponse {
+	keys := make([]string, len(succeeded))
+	for i, rel := range succeeded {
+		keys[i] = j.Src + rel
+	}
+	return renameResponse{
+		ID:        j.ID,
+		Status:    j.Status,
+		Moved:     len(succeeded),
+		Succeeded: keys,
+		Failed:    j.Failed,
+		Took:      time.Since(start).Milliseconds(),
+	}
+}
+
+func renameConcurrency(n int) int {
+	if n <= 0 {
+		return renameWorkers
+	}
+	return min(n, maxRenameWorkers)
+}
+
+func (p *proxy) renamePrefix(ctx context.Context, bucket, src, dst string, workers int) (*renameJournal, []string, error) {
+	rels, sizes, err := p.pendingRels(ctx, bucket, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &renameJournal{ID: newJournalID(), Profile: p.name, Bucket: bucket, Src: src, Dst: dst, Status: renameStatusRunning, Moved: []string{}, Started: time.Now().UTC()}
+	if err := p.saveJournal(j); err != nil {
+		return nil, nil, fmt.Errorf("journal: %w", err)
+	}
+	moved, err := p.moveJournaled(ctx, j, rels, sizes, renameConcurrency(workers))
+	return j, moved, err
+}
+
+type renameJournalRequest struct {
+	ID          string `json:"id"`
+	Concurrency int    `json:"concurrency,omitempty"`
+}
+
+func (p *proxy) journalRequest(w http.ResponseWriter, r *http.Request) (*renameJournal, int, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, 0, false
+	}
+	var req renameJournalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	j, err := p.loadJournal(req.ID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("rename %q not found", req.ID), http.StatusNotFound)
+		return nil, 0, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("journal: %v", err), http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	if _, ok := p.resolveBucket(w, r, j.Bucket); !ok {
+		return nil, 0, false
+	}
+	if !p.authorize(w, r, actRead, j.Bucket, j.Src) || !p.authorize(w, r, actDelete, j.Bucket, j.Src) ||
+		!p.authorize(w, r, actRead, j.Bucket, j.Dst) || !p.authorize(w, r, actDelete, j.Bucket, j.Dst) ||
+		!p.authorize(w, r, actWrite, j.Bucket, j.Src) || !p.authorize(w, r, actWrite, j.Bucket, j.Dst) {
+		return nil, 0, false
+	}
+	return j, renameConcurrency(req.Concurrency), true
+}
+
+// handleRenameResume moves whatever is still left under the source prefix of
+// a previous partial rename.
+func (p *proxy) handleRenameResume(w http.ResponseWriter, r *http.Request) {
+	j, workers, ok := p.journalRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	start := time.Now()
+	rels, sizes, err := p.pendingRels(ctx, j.Bucket, j.Src)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list: %v", err), http.StatusBadGateway)
+		return
+	}
+	moved, err := p.moveJournaled(ctx, j, rels, sizes, workers)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("journal: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(j.response(moved, start))
+}
+
+// handleRenameRollback moves the keys recorded by a rename back to their
+// original location. Keys that already existed under the destination are
+// left alone.
+func (p *proxy) handleRenameRollback(w http.ResponseWriter, r *http.Request) {
+	j, workers, ok := p.journalRequest(w, r)
+	if !ok {
+		return
+	}
+	start := time.Now()
+	back, failed := p.moveKeys(r.Context(), j.Bucket, j.Dst, j.Src, j.Moved, nil, workers)
+
+	done := make(map[string]bool, len(back))
+	for _, rel := range back {
+		done[rel] = true
+	}
+	remaining := j.Moved[:0]
+	for _, rel := range j.Moved {
+		if !done[rel] {
+			remaining = append(remaining, rel)
+		}
+	}
+	j.Moved, j.Failed = remaining, failed
+	j.Status = renameStatusUndone
+	if len(failed) > 0 {
+		j.Status = renameStatusPartly
+	}
+	if err := p.saveJournal(j); err != nil {
+		http.Error(w, fmt.Sprintf("journal: %v", err), http.StatusInternalServerError)
+		return
+	}
+	out := j.response(nil, start)
+	out.Moved = len(back)
+	for _, rel := range back {
+		out.Succeeded = append(out.Succeeded, j.Dst+rel)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const streamFlushInterval = 100 * time.Millisecond
+
+// streamMode returns "sse" or "ndjson" when the client asked for a live
+// progress stream, through ?stream= or the Accept header, and "" otherwise.
+func streamMode(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("stream")) {
+	case "sse":
+		return "sse"
+	case "ndjson", "1", "true":
+		return "ndjson"
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		return "sse"
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson"
+	}
+	return ""
+}
+
+type streamEvent struct {
+	Type       string `json:"type"`
+	Key        string `json:"key,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Done       int64  `json:"done"`
+	Total      int64  `json:"total"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"totalBytes"`
+	Failed     int64  `json:"failed"`
+	Result     any    `json:"result,omitempty"`
+}
+
+// streamWriter is a progress reporter that writes one event per key to the
+// response, as Server-Sent Events or newline-delimited JSON.
+type streamWriter struct {
+	mu    sync.Mutex
+	w     http.ResponseWriter
+	rc    *http.ResponseController
+	sse   bool
+	last  time.Time
+	state streamEvent
+}
+
+func (s *streamWriter) emit(ev streamEvent, flush bool) {
+	b, _ := json.Marshal(ev)
+	if s.sse {
+		_, _ = s.w.Write([]byte("event: " + ev.Type + "\ndata: "))
+		_, _ = s.w.Write(b)
+		_, _ = s.w.Write([]byte("\n\n"))
+	} else {
+		_, _ = s.w.Write(append(b, '\n'))
+	}
+	if flush || time.Since(s.last) >= streamFlushInterval {
+		_ = s.rc.Flush()
+		s.last = time.Now()
+	}
+}
+
+func (s *streamWriter) addTotal(n int, b int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Total += int64(n)
+	s.state.TotalBytes += b
+	ev := s.state
+	ev.Type = "total"
+	s.emit(ev, true)
+}
+
+func (s *streamWriter) step(key string, b int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Done++
+	ev := s.state
+	ev.Type, ev.Key = "progress", key
+	if err != nil {
+		s.state.Failed++
+		ev.Failed, ev.Error = s.state.Failed, err.Error()
+	} else {
+		s.state.Bytes += b
+		ev.Bytes = s.state.Bytes
+	}
+	s.emit(ev, false)
+}
+
+// stream runs fn with a progress reporter bound to the response and ends
+// with a "done" event carrying the result, or an "error" event.
+func (p *proxy) stream(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context) (any, error)) {
+	mode := streamMode(r)
+	s := &streamWriter{w: w, rc: http.NewResponseController(w), sse: mode == "sse"}
+	if s.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	s.emit(streamEvent{Type: "start"}, true)
+
+	res, err := fn(withProgress(r.Context(), s))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev := s.state
+	if err != nil {
+		ev.Type, ev.Error = "error", err.Error()
+	} else {
+		ev.Type, ev.Result = "done", res
+	}
+	s.emit(ev, true)
+}
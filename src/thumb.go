@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbCacheDisk   = "disk"
+	thumbCacheBucket = "bucket"
+	thumbCacheNone   = "none"
+
+	thumbDefaultSize = 256
+	thumbMinSize     = 16
+	thumbMaxSize     = 1024
+	// thumbMaxPixels bounds the decoded size of a source (256 MiB as RGBA),
+	// whatever the size of its file.
+	thumbMaxPixels   = 64 << 20
+	thumbJPEGQuality = 85
+)
+
+var (
+	errNotImage      = errors.New("not a JPEG, PNG, GIF or WebP image")
+	errImageTooLarge = errors.New("image too large for a thumbnail")
+)
+
+// thumbSem bounds the number of images decoded at once, since each one can
+// take hundreds of megabytes.
+var thumbSem = make(chan struct{}, max(2, runtime.NumCPU()/2))
+
+// thumbSpec is the box a thumbnail fits in, and its format: "jpeg", "png",
+// or "" for JPEG unless the image has transparency.
+type thumbSpec struct {
+	w, h   int
+	format string
+}
+
+func parseThumbSpec(q url.Values) (thumbSpec, error) {
+	s := thumbSpec{w: thumbDefaultSize, h: thumbDefaultSize}
+	for _, d := range []struct {
+		name string
+		dst  *int
+	}{{"w", &s.w}, {"h", &s.h}} {
+		v := q.Get(d.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < thumbMinSize || n > thumbMaxSize {
+			return s, fmt.Errorf("%s must be between %d and %d", d.name, thumbMinSize, thumbMaxSize)
+		}
+		*d.dst = n
+	}
+	switch f := strings.ToLower(q.Get("format")); f {
+	case "", "auto":
+	case "jpeg", "jpg":
+		s.format = "jpeg"
+	case "png":
+		s.format = "png"
+	default:
+		return s, fmt.Errorf("unknown format %q", f)
+	}
+	return s, nil
+}
+
+// thumbName identifies a thumbnail by the object, its ETag and the spec, so
+// that a replaced image never gets its old thumbnail back.
+func (p *proxy) thumbName(bucket, key, etag string, s thumbSpec) string {
+	sum := sha256.Sum256([]byte(p.name + "\x00" + bucket + "\x00" + key + "\x00" + etag))
+	name := fmt.Sprintf("%s-%dx%d", hex.EncodeToString(sum[:16]), s.w, s.h)
+	if s.format != "" {
+		name += "-" + s.format
+	}
+	return name
+}
+
+func (p *proxy) thumbPath(name string) string {
+	return filepath.Join(p.global.StateDir, "thumbs", name[:2], name)
+}
+
+// thumbKey is the key of a cached thumbnail in the bucket cache. Like every
+// key here it is relative to the profile root prefix, which objectURL adds,
+// so each jailed profile keeps its own cache inside its root.
+func (p *proxy) thumbKey(name string) string {
+	return p.global.Thumbs.Prefix + name[:2] + "/" + name
+}
+
+// inThumbs reports whether key, relative to the root prefix, belongs to the
+// bucket cache of thumbnails.
+func (p *proxy) inThumbs(key string) bool {
+	return p.global.Thumbs.Cache == thumbCacheBucket && strings.HasPrefix(key, p.global.Thumbs.Prefix)
+}
+
+// skipThumb reports whether an operation on scope should leave key alone:
+// the bucket cache is hidden from listings and bulk operations, unless they
+// target the cache itself.
+func (p *proxy) skipThumb(scope, key string) bool {
+	return p.inThumbs(key) && !p.inThumbs(scope)
+}
+
+// hideThumbs drops the bucket cache from a listing of prefix.
+func (p *proxy) hideThumbs(lb *listBucketResultV2, prefix string) {
+	cps := lb.CommonPrefixes[:0]
+	for _, cp := range lb.CommonPrefixes {
+		if !p.skipThumb(prefix, cp.Prefix) {
+			cps = append(cps, cp)
+		}
+	}
+	lb.CommonPrefixes = cps
+	cs := lb.Contents[:0]
+	for _, c := range lb.Contents {
+		if !p.skipThumb(prefix, c.Key) {
+			cs = append(cs, c)
+		}
+	}
+	lb.Contents = cs
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 asks for GET.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxy) cachedThumb(ctx context.Context, bucket, name string) ([]byte, bool) {
+	switch p.global.Thumbs.Cache {
+	case thumbCacheDisk:
+		b, err := os.ReadFile(p.thumbPath(name))
+		return b, err == nil
+	case thumbCacheBucket:
+		b, err := p.getObjectBytes(ctx, bucket, p.thumbKey(name))
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Printf("thumb cache %s/%s: %v", bucket, name, err)
+		}
+		return b, err == nil
+	}
+	return nil, false
+}
+
+// storeThumb keeps a thumbnail for the next request. Failures only cost a
+// new rendering, so they are logged. A thumbnail is served on a GET, so it
+// is only written to the bucket for callers allowed to write its key there.
+func (p *proxy) storeThumb(ctx context.Context, bucket, name, contentType string, data []byte) {
+	var err error
+	switch p.global.Thumbs.Cache {
+	case thumbCacheDisk:
+		err = writeFileAtomic(p.thumbPath(name), data)
+	case thumbCacheBucket:
+		if p.global.ReadOnly || !p.policy.allowed(identityFrom(ctx), actWrite, bucket, p.thumbKey(name)) {
+			return
+		}
+		err = p.putObjectBytes(context.WithoutCancel(ctx), bucket, p.thumbKey(name), contentType, data)
+	}
+	if err != nil {
+		log.Printf("thumb cache %s/%s: %v", bucket, name, err)
+	}
+}
+
+// writeFileAtomic writes data through a temporary file, so that concurrent
+// readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// makeThumb decodes an image and renders it to fit in the box of s,
+// keeping its aspect ratio and never enlarging it.
+func (p *proxy) makeThumb(ctx context.Context, bucket, key, etag string, s thumbSpec) ([]byte, string, error) {
+	select {
+	case thumbSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+	defer func() { <-thumbSem }()
+
+	body, err := p.openObject(ctx, bucket, key, etag, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	src, err := io.ReadAll(io.LimitReader(body, p.global.Thumbs.maxSourceSize()+1))
+	body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(src)) > p.global.Thumbs.maxSourceSize() {
+		return nil, "", errImageTooLarge
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errNotImage, err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > thumbMaxPixels {
+		return nil, "", fmt.Errorf("%w (%dx%d)", errImageTooLarge, cfg.Width, cfg.Height)
+	}
+	img, format, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errNotImage, err)
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(src)
+	}
+
+	out := s.format
+	if out == "" {
+		out = "jpeg"
+		if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+			out = "png"
+		}
+	}
+	// Orientations 5 to 8 swap the sides of the stored image.
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	bw, bh := s.w, s.h
+	if orientation >= 5 {
+		bw, bh = bh, bw
+	}
+	scale := min(float64(bw)/float64(sw), float64(bh)/float64(sh), 1)
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(sw)*scale+0.5)), max(1, int(float64(sh)*scale+0.5))))
+	op := draw.Src
+	if out == "jpeg" {
+		// JPEG has no alpha: put transparent pixels on white, not black.
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), op, nil)
+	dst = orient(dst, orientation)
+
+	var buf bytes.Buffer
+	if out == "png" {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbJPEGQuality})
+	}
+	return buf.Bytes(), "image/" + out, err
+}
+
+// jpegOrientation returns the EXIF orientation (1 to 8) of a JPEG, or 1
+// when it has none.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return 1
+		}
+		marker := b[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image: no more metadata.
+			return 1
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return 1
+		}
+		if seg := b[i+4 : i+2+n]; marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+// exifOrientation reads the Orientation tag of the first IFD of a TIFF
+// header.
+func exifOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	off := int(bo.Uint32(t[4:]))
+	if off < 8 || off+2 > len(t) {
+		return 1
+	}
+	for i, n := 0, int(bo.Uint16(t[off:])); i < n; i++ {
+		e := off + 2 + 12*i
+		if e+12 > len(t) {
+			return 1
+		}
+		if bo.Uint16(t[e:]) == 0x0112 {
+			if v := int(bo.Uint16(t[e+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient turns an image stored with the given EXIF orientation upright.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// handleThumb serves a small JPEG or PNG rendering of an image object. The
+// result is cached by ETag, and answers 304 to a browser that has it.
+func (p *proxy) handleThumb(w http.ResponseWriter, r *http.Request) {
+	bucket, key, ok := p.readTarget(w, r)
+	if !ok {
+		return
+	}
+	s, err := parseThumbSpec(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	h, err := p.headObject(ctx, bucket, key)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("%s not found", key), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	name := p.thumbName(bucket, key, h.ETag, s)
+	etag := `"` + name + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if data, ok := p.cachedThumb(ctx, bucket, name); ok {
+		writeThumb(w, http.DetectContentType(data), "hit", data)
+		return
+	}
+	if h.Size > p.global.Thumbs.maxSourceSize() {
+		http.Error(w, errImageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, ct, err := p.makeThumb(ctx, bucket, key, h.ETag, s)
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotFound):
+		http.Error(w, fmt.Sprintf("%s not found", key), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotImage):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errors.Is(err, errImageTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	p.storeThumb(ctx, bucket, name, ct, data)
+	writeThumb(w, ct, "miss", data)
+}
+
+func writeThumb(w http.ResponseWriter, contentType, cache string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Thumb-Cache", cache)
+	_, _ = w.Write(data)
+}
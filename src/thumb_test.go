@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseThumbSpec(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  thumbSpec
+		ok    bool
+	}{
+		{"", thumbSpec{w: 256, h: 256}, true},
+		{"w=64", thumbSpec{w: 64, h: 256}, true},
+		{"w=64&h=48", thumbSpec{w: 64, h: 48}, true},
+		{"w=16&h=1024", thumbSpec{w: 16, h: 1024}, true},
+		{"format=auto", thumbSpec{w: 256, h: 256}, true},
+		{"format=JPG", thumbSpec{w: 256, h: 256, format: "jpeg"}, true},
+		{"format=jpeg", thumbSpec{w: 256, h: 256, format: "jpeg"}, true},
+		{"format=png", thumbSpec{w: 256, h: 256, format: "png"}, true},
+		{"w=15", thumbSpec{}, false},
+		{"h=1025", thumbSpec{}, false},
+		{"w=abc", thumbSpec{}, false},
+		{"w=-64", thumbSpec{}, false},
+		{"format=gif", thumbSpec{}, false},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		got, err := parseThumbSpec(q)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseThumbSpec(%q) error = %v, want ok %v", tc.query, err, tc.ok)
+			continue
+		}
+		if tc.ok && got != tc.want {
+			t.Errorf("parseThumbSpec(%q) = %+v, want %+v", tc.query, got, tc.want)
+		}
+	}
+}
+
+// exifJPEG returns the start of a JPEG whose APP1 segment holds a TIFF
+// header with one Orientation entry.
+func exifJPEG(order string, orientation byte) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	tiff[18] = orientation
+	if order == "MM" {
+		tiff = []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+		tiff[19] = orientation
+	}
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	n := len(seg) + 2
+	b := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x04, 0x00, 0x00, 0xff, 0xe1, byte(n >> 8), byte(n)}
+	b = append(b, seg...)
+	return append(b, 0xff, 0xda, 0x00, 0x02)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	truncated := exifJPEG("II", 6)
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want int
+	}{
+		{"little endian", exifJPEG("II", 6), 6},
+		{"big endian", exifJPEG("MM", 8), 8},
+		{"upright", exifJPEG("II", 1), 1},
+		{"out of range", exifJPEG("II", 9), 1},
+		{"zero", exifJPEG("MM", 0), 1},
+		{"no exif", []byte{0xff, 0xd8, 0xff, 0xda, 0x00, 0x02}, 1},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"truncated", truncated[:len(truncated)-12], 1},
+		{"empty", nil, 1},
+		{"bad segment length", []byte{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x01, 0x00}, 1},
+	} {
+		if got := jpegOrientation(tc.b); got != tc.want {
+			t.Errorf("jpegOrientation(%s) = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc-64x64"`
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc-64x64"`, true},
+		{`W/"abc-64x64"`, true},
+		{`"x", "abc-64x64"`, true},
+		{`"x",W/"abc-64x64"`, true},
+		{`*`, true},
+		{``, false},
+		{`"abc"`, false},
+		{`abc-64x64`, false},
+		{`"x", "y"`, false},
+	} {
+		if got := etagMatches(tc.header, etag); got != tc.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestSkipThumb(t *testing.T) {
+	p := &proxy{global: cfg{Thumbs: thumbsCfg{Cache: thumbCacheBucket, Prefix: ".thumbs/"}}}
+	for _, tc := range []struct {
+		scope, key string
+		want       bool
+	}{
+		{"", ".thumbs/ab/abcd", true},
+		{"", "photos/a.jpg", false},
+		{".th", ".thumbs/ab/abcd", true},
+		{".thumbs/", ".thumbs/ab/abcd", false},
+		{".thumbs/ab/", ".thumbs/ab/abcd", false},
+		{"", ".thumbsx/a", false},
+	} {
+		if got := p.skipThumb(tc.scope, tc.key); got != tc.want {
+			t.Errorf("skipThumb(%q, %q) = %v, want %v", tc.scope, tc.key, got, tc.want)
+		}
+	}
+	disk := &proxy{global: cfg{Thumbs: thumbsCfg{Cache: thumbCacheDisk, Prefix: ".thumbs/"}}}
+	if disk.skipThumb("", ".thumbs/ab/abcd") {
+		t.Error("skipThumb with a disk cache hides bucket keys")
+	}
+}
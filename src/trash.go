@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	trashIDLayout       = "20060102T150405Z"
+	trashManifestExt    = ".json"
+	trashListWorkers    = 8
+	defaultTrashPurge   = time.Hour
+	defaultTrashKeepFor = 30 * 24 * time.Hour
+)
+
+// trashEntry is the manifest stored next to every trashed object or prefix.
+// Objects live under <trashPrefix><id>/<original key>, the manifest at
+// <trashPrefix><id>.json.
+type trashEntry struct {
+	ID        string    `json:"id"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	IsPrefix  bool      `json:"isPrefix"`
+	Count     int       `json:"count"`
+	Objects   []string  `json:"objects,omitempty"`
+	DeletedBy string    `json:"deletedBy"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+func newTrashID(now time.Time) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return now.UTC().Format(trashIDLayout) + "-" + hex.EncodeToString(b)
+}
+
+func trashIDTime(id string) (time.Time, bool) {
+	ts, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(trashIDLayout, ts)
+	return t, err == nil
+}
+
+func (p *proxy) trashPrefix() string { return p.global.UI.TrashPrefix }
+
+func (p *proxy) inTrash(key string) bool { return strings.HasPrefix(key, p.trashPrefix()) }
+
+func (p *proxy) trashDataPrefix(id string) string { return p.trashPrefix() + id + "/" }
+
+func (p *proxy) trashManifestKey(id string) string { return p.trashPrefix() + id + trashManifestExt }
+
+// moveToTrash copies key (or every object under it) into a new trash entry,
+// writes the manifest and only then deletes the originals. A failed copy
+// rolls the entry back so the originals are never left without a copy.
+func (p *proxy) moveToTrash(ctx context.Context, bucket, key string, isPrefix bool, by string) (trashEntry, error) {
+	now := time.Now().UTC()
+	e := trashEntry{ID: newTrashID(now), Bucket: bucket, Key: key, IsPrefix: isPrefix, DeletedBy: by, DeletedAt: now}
+
+	if isPrefix {
+		keys, err := p.listAllKeys(ctx, bucket, key)
+		if err != nil {
+			return e, fmt.Errorf("list: %w", err)
+		}
+		for _, k := range keys {
+			if !p.inTrash(k) && !p.skipThumb(key, k) {
+				e.Objects = append(e.Objects, k)
+			}
+		}
+		if len(e.Objects) == 0 {
+			return e, errNotFound
+		}
+	} else {
+		ok, err := p.objectExists(ctx, bucket, key)
+		if err != nil {
+			return e, err
+		}
+		if !ok {
+			return e, errNotFound
+		}
+		e.Objects = []string{key}
+	}
+	e.Count = len(e.Objects)
+
+	data := p.trashDataPrefix(e.ID)
+	for i, k := range e.Objects {
+		if err := p.copyObject(ctx, bucket, k, data+k); err != nil {
+			for _, done := range e.Objects[:i] {
+				_ = p.deleteObject(context.WithoutCancel(ctx), bucket, data+done)
+			}
+			return e, fmt.Errorf("copy %s: %w", k, err)
+		}
+	}
+	b, _ := json.Marshal(e)
+	if err := p.putObjectBytes(ctx, bucket, p.trashManifestKey(e.ID), "application/json", b); err != nil {
+		return e, fmt.Errorf("manifest: %w", err)
+	}
+
+	if _, failed := p.deleteKeys(ctx, bucket, e.Objects); len(failed) > 0 {
+		keys := make([]string, len(failed))
+		for i, f := range failed {
+			keys[i] = f.Key
+		}
+		return e, fmt.Errorf("trashed as %s but %d original(s) could not be deleted: %s", e.ID, len(failed), strings.Join(keys, ", "))
+	}
+	return e, nil
+}
+
+func (p *proxy) readTrashEntry(ctx context.Context, bucket, id string) (trashEntry, error) {
+	var e trashEntry
+	b, err := p.getObjectBytes(ctx, bucket, p.trashManifestKey(id))
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, fmt.Errorf("manifest %s: %w", id, err)
+	}
+	return e, nil
+}
+
+// trashIDs lists the entry ids of a bucket from the manifest keys, without
+// walking the trashed objects themselves.
+func (p *proxy) trashIDs(ctx context.Context, bucket string) ([]string, error) {
+	var ids []string
+	prefix := p.trashPrefix()
+	after := ""
+	for {
+		lb, err := p.s3ListPage(ctx, bucket, prefix, "/", after, 1000)
+		if err != nil {
+			return nil, err
+		}
+		last := ""
+		for _, c := range lb.Contents {
+			if name := strings.TrimPrefix(c.Key, prefix); strings.HasSuffix(name, trashManifestExt) {
+				ids = append(ids, strings.TrimSuffix(name, trashManifestExt))
+			}
+			if c.Key > last {
+				last = c.Key
+			}
+		}
+		for _, cp := range lb.CommonPrefixes {
+			// Skip the whole data folder: '0' (0x30) is the byte right after
+			// '/' (0x2f), so "id0" sorts after every "id/..." key.
+			if k := strings.TrimSuffix(cp.Prefix, "/") + "0"; k > last {
+				last = k
+			}
+		}
+		if !lb.IsTruncated || last == "" {
+			break
+		}
+		after = last
+	}
+	return ids, nil
+}
+
+func (p *proxy) listTrash(ctx context.Context, bucket string) ([]trashEntry, error) {
+	ids, err := p.trashIDs(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]trashEntry, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, trashListWorkers)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out[i], errs[i] = p.readTrashEntry(ctx, bucket, id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	entries := out[:0]
+	for i, e := range out {
+		if errs[i] != nil {
+			log.Printf("trash %s/%s: %v", bucket, ids[i], errs[i])
+			continue
+		}
+		e.Objects = nil
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt.After(entries[j].DeletedAt) })
+	return entries, nil
+}
+
+var errRestoreConflict = errors.New("restore target exists")
+
+// checkManifest makes sure that a manifest read back from the bucket only
+// names its own key, or keys under it for a folder: whoever can write the
+// manifest must not be able to make a restore overwrite other keys.
+func (p *proxy) checkManifest(e trashEntry) error {
+	key, err := cleanKey(e.Key)
+	if err != nil || key != e.Key || key == "" || p.inTrash(key) {
+		return fmt.Errorf("invalid trash entry key %q", e.Key)
+	}
+	if !e.IsPrefix && (len(e.Objects) != 1 || e.Objects[0] != key) {
+		return fmt.Errorf("trash entry for %q lists other objects", key)
+	}
+	under := strings.TrimSuffix(key, "/") + "/"
+	for _, k := range e.Objects {
+		if ck, err := cleanKey(k); err != nil || ck != k || p.inTrash(k) || (k != key && !strings.HasPrefix(k, under)) {
+			return fmt.Errorf("trash entry object %q is outside %q", k, key)
+		}
+	}
+	return nil
+}
+
+func (p *proxy) restoreFromTrash(ctx context.Context, bucket string, e trashEntry, overwrite bool) (int, error) {
+	if !overwrite {
+		for _, k := range e.Objects {
+			ok, err := p.objectExists(ctx, bucket, k)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				return 0, fmt.Errorf("%w: %s", errRestoreConflict, k)
+			}
+		}
+	}
+	data := p.trashDataPrefix(e.ID)
+	for i, k := range e.Objects {
+		if err := p.copyObject(ctx, bucket, data+k, k); err != nil {
+			return i, fmt.Errorf("restore %s: %w", k, err)
+		}
+	}
+	if err := p.removeTrashEntry(ctx, bucket, e.ID); err != nil {
+		return len(e.Objects), err
+	}
+	return len(e.Objects), nil
+}
+
+func (p *proxy) removeTrashEntry(ctx context.Context, bucket, id string) error {
+	keys, err := p.listAllKeys(ctx, bucket, p.trashDataPrefix(id))
+	if err != nil {
+		return err
+	}
+	if _, failed := p.deleteKeys(ctx, bucket, keys); len(failed) > 0 {
+		return fmt.Errorf("delete %s: %s", failed[0].Key, failed[0].Error)
+	}
+	return p.deleteObject(ctx, bucket, p.trashManifestKey(id))
+}
+
+// purgeTrash removes the entries of bucket that were created before cutoff.
+func (p *proxy) purgeTrash(ctx context.Context, bucket string, cutoff time.Time) (int, error) {
+	ids, err := p.trashIDs(ctx, bucket)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		t, ok := trashIDTime(id)
+		if !ok || !t.Before(cutoff) {
+			continue
+		}
+		if err := p.removeTrashEntry(ctx, bucket, id); err != nil {
+			return n, fmt.Errorf("%s: %w", id, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+type trashRequest struct {
+	Bucket   string `json:"bucket,omitempty"`
+	Key      string `json:"key"`
+	IsPrefix bool   `json:"isPrefix"`
+}
+
+type trashResponse struct {
+	ID    string `json:"id"`
+	Moved int    `json:"moved"`
+	Took  int64  `json:"tookMs"`
+}
+
+func (p *proxy) handleTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req trashRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, req.Bucket)
+	if !ok {
+		return
+	}
+	key, err := cleanKey(req.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.IsPrefix && key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	if key == "" || p.inTrash(key) || strings.HasPrefix(p.trashPrefix(), key) {
+		http.Error(w, "key cannot be trashed", http.StatusBadRequest)
+		return
+	}
+	del := actDelete
+	if req.IsPrefix {
+		del = actDeletePrefix
+	}
+	if !p.authorize(w, r, actRead, bucket, key) || !p.authorize(w, r, del, bucket, key) {
+		return
+	}
+
+	start := time.Now()
+	by := "anonymous"
+	if id := identityFrom(r.Context()); id != nil {
+		by = id.Name
+	}
+	e, err := p.moveToTrash(r.Context(), bucket, key, req.IsPrefix, by)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("%s not found", key), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("trash: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("trash: %s moved %s/%s to %s (%d objects)", by, bucket, key, e.ID, e.Count)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(trashResponse{ID: e.ID, Moved: e.Count, Took: time.Since(start).Milliseconds()})
+}
+
+type trashListResponse struct {
+	Bucket      string       `json:"bucket"`
+	TrashPrefix string       `json:"trashPrefix"`
+	Retention   string       `json:"retention,omitempty"`
+	Items       []trashEntry `json:"items"`
+}
+
+func (p *proxy) handleTrashList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bucket, ok := p.requestBucket(w, r)
+	if !ok {
+		return
+	}
+	entries, err := p.listTrash(r.Context(), bucket)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("trash: %v", err), http.StatusBadGateway)
+		return
+	}
+	id := identityFrom(r.Context())
+	out := trashListResponse{Bucket: bucket, TrashPrefix: p.trashPrefix(), Items: make([]trashEntry, 0, len(entries))}
+	if ret := p.global.Trash.retention(); ret > 0 {
+		out.Retention = ret.String()
+	}
+	for _, e := range entries {
+		if p.policy.allowed(id, actRead, bucket, e.Key) {
+			out.Items = append(out.Items, e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+type trashRestoreRequest struct {
+	Bucket    string `json:"bucket,omitempty"`
+	ID        string `json:"id"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+type trashRestoreResponse struct {
+	Key      string `json:"key"`
+	Restored int    `json:"restored"`
+	Took     int64  `json:"tookMs"`
+}
+
+func (p *proxy) handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req trashRestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, req.Bucket)
+	if !ok {
+		return
+	}
+	if _, ok := trashIDTime(req.ID); !ok || strings.ContainsAny(req.ID, "/.") {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	e, err := p.readTrashEntry(ctx, bucket, req.ID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("trash entry %s not found", req.ID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("trash: %v", err), http.StatusBadGateway)
+		return
+	}
+	if err := p.checkManifest(e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Access follows the original keys, as in the listing, so that no
+	// policy has to grant anything on the trash folder itself.
+	if !p.authorize(w, r, actRead, bucket, e.Key) || !p.authorize(w, r, actWrite, bucket, e.Key) {
+		return
+	}
+	id := identityFrom(ctx)
+	for _, k := range e.Objects {
+		if !p.policy.allowed(id, actRead, bucket, k) || !p.policy.allowed(id, actWrite, bucket, k) {
+			http.Error(w, fmt.Sprintf("forbidden: restore %s/%s", bucket, k), http.StatusForbidden)
+			return
+		}
+	}
+
+	start := time.Now()
+	n, err := p.restoreFromTrash(ctx, bucket, e, req.Overwrite)
+	if errors.Is(err, errRestoreConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("restore: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(trashRestoreResponse{Key: e.Key, Restored: n, Took: time.Since(start).Milliseconds()})
+}
+
+// purgeTrashLoop periodically drops trash entries older than the configured
+// retention, in every bucket of every profile of the current configuration.
+func (s *server) purgeTrashLoop() {
+	for {
+		t := s.current.Load().cfg.Trash
+		time.Sleep(t.purgeInterval())
+
+		reg := s.current.Load()
+		ret := reg.cfg.Trash.retention()
+		if ret <= 0 || reg.cfg.ReadOnly {
+			continue
+		}
+		cutoff := time.Now().Add(-ret)
+		for _, name := range reg.names {
+			p := reg.profiles[name]
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+			buckets, err := p.buckets(ctx)
+			if err != nil {
+				log.Printf("trash purge %s: %v", name, err)
+			}
+			for _, b := range buckets {
+				n, err := p.purgeTrash(ctx, b, cutoff)
+				if err != nil {
+					log.Printf("trash purge %s/%s: %v", name, b, err)
+				}
+				if n > 0 {
+					log.Printf("trash purge %s/%s: removed %d entries", name, b, n)
+				}
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCheckManifest(t *testing.T) {
+	p := &proxy{global: cfg{UI: uiCfg{TrashPrefix: "_trash/"}}}
+	for _, tc := range []struct {
+		e  trashEntry
+		ok bool
+	}{
+		{trashEntry{Key: "a.txt", Objects: []string{"a.txt"}}, true},
+		{trashEntry{Key: "a.txt", Objects: []string{"a.txt", "b.txt"}}, false},
+		{trashEntry{Key: "a.txt", Objects: []string{"a.txt/x"}}, false},
+		{trashEntry{Key: "dir/", IsPrefix: true, Objects: []string{"dir/a", "dir/sub/b"}}, true},
+		{trashEntry{Key: "dir/", IsPrefix: true, Objects: []string{"dir/a", "index.html"}}, false},
+		{trashEntry{Key: "dir/", IsPrefix: true, Objects: []string{"dirt/a"}}, false},
+		{trashEntry{Key: "dir/", IsPrefix: true, Objects: []string{"dir/../index.html"}}, false},
+		{trashEntry{Key: "dir/", IsPrefix: true, Objects: []string{"dir//a"}}, false},
+		{trashEntry{Key: "", IsPrefix: true, Objects: []string{"a"}}, false},
+		{trashEntry{Key: "_trash/", IsPrefix: true, Objects: []string{"_trash/x"}}, false},
+		{trashEntry{Key: "/dir/", IsPrefix: true, Objects: []string{"/dir/a"}}, false},
+	} {
+		if err := p.checkManifest(tc.e); (err == nil) != tc.ok {
+			t.Errorf("checkManifest(%+v) = %v, want ok %v", tc.e, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusPartSize   = uploadPartSize
+	tusExpiry     = 7 * 24 * time.Hour
+)
+
+// tusUpload is the persisted state of a tus upload. Bytes that do not yet
+// fill an S3 part wait in a spill file next to the state, so that the
+// offset survives a restart: it is the size of the parts sent to S3 plus
+// the size of the spill file.
+type tusUpload struct {
+	ID          string          `json:"id"`
+	Profile     string          `json:"profile"`
+	Bucket      string          `json:"bucket"`
+	Key         string          `json:"key"`
+	Owner       string          `json:"owner,omitempty"`
+	Length      int64           `json:"length"`
+	ContentType string          `json:"contentType,omitempty"`
+	Metadata    string          `json:"metadata,omitempty"`
+	UploadID    string          `json:"uploadId,omitempty"`
+	Parts       []completedPart `json:"parts,omitempty"`
+	PartsBytes  int64           `json:"partsBytes"`
+	PartSize    int64           `json:"partSize,omitempty"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+	Done        bool            `json:"done,omitempty"`
+}
+
+// partSize is the size of the parts sent to S3; states saved before it was
+// recorded used tusPartSize.
+func (u *tusUpload) partSize() int64 {
+	if u.PartSize > 0 {
+		return u.PartSize
+	}
+	return tusPartSize
+}
+
+// tusLocks serializes requests on the same upload. An entry lives as long as
+// a request holds or tries its mutex, so two requests never get different
+// mutexes for one upload, and the last one out drops it. Holders load the
+// upload state after locking, so they see a completed or removed upload.
+var (
+	tusLocksMu sync.Mutex
+	tusLocks   = map[string]*tusLockEntry{}
+)
+
+type tusLockEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func tusLock(id string) (func(), bool) {
+	tusLocksMu.Lock()
+	e := tusLocks[id]
+	if e == nil {
+		e = &tusLockEntry{}
+		tusLocks[id] = e
+	}
+	e.refs++
+	tusLocksMu.Unlock()
+	release := func() {
+		tusLocksMu.Lock()
+		if e.refs--; e.refs == 0 {
+			delete(tusLocks, id)
+		}
+		tusLocksMu.Unlock()
+	}
+	if !e.mu.TryLock() {
+		release()
+		return nil, false
+	}
+	return func() {
+		e.mu.Unlock()
+		release()
+	}, true
+}
+
+func (p *proxy) tusDir() string { return filepath.Join(p.global.StateDir, "tus") }
+
+func (p *proxy) tusStatePath(id string) string { return filepath.Join(p.tusDir(), id+".json") }
+
+func (p *proxy) tusSpillPath(id string) string { return filepath.Join(p.tusDir(), id+".bin") }
+
+func (p *proxy) saveTus(u *tusUpload) error {
+	if err := os.MkdirAll(p.tusDir(), 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := p.tusStatePath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.tusStatePath(u.ID))
+}
+
+func (p *proxy) loadTus(id string) (*tusUpload, error) {
+	if !validJournalID(id) {
+		return nil, errNotFound
+	}
+	b, err := os.ReadFile(p.tusStatePath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	if u.Profile != p.name {
+		return nil, errNotFound
+	}
+	return &u, nil
+}
+
+func (p *proxy) removeTus(u *tusUpload) {
+	_ = os.Remove(p.tusSpillPath(u.ID))
+	_ = os.Remove(p.tusStatePath(u.ID))
+}
+
+func (p *proxy) spillSize(u *tusUpload) int64 {
+	fi, err := os.Stat(p.tusSpillPath(u.ID))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (p *proxy) tusOffset(u *tusUpload) int64 {
+	if u.Done {
+		return u.Length
+	}
+	return u.PartsBytes + p.spillSize(u)
+}
+
+// pruneTus aborts and forgets the expired uploads of this profile.
+func (p *proxy) pruneTus(ctx context.Context) {
+	ents, err := os.ReadDir(p.tusDir())
+	if err != nil {
+		return
+	}
+	for _, e := range ents {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		p.pruneOne(ctx, id)
+	}
+}
+
+// pruneOne removes upload id if it expired and no request is working on it.
+func (p *proxy) pruneOne(ctx context.Context, id string) {
+	unlock, ok := tusLock(id)
+	if !ok {
+		return
+	}
+	defer unlock()
+	u, err := p.loadTus(id)
+	if err != nil || time.Now().Before(u.Expires) {
+		return
+	}
+	if u.UploadID != "" && !u.Done {
+		if err := p.abortMultipart(ctx, u.Bucket, u.Key, u.UploadID); err != nil {
+			log.Printf("tus %s: abort expired upload: %v", u.ID, err)
+			return
+		}
+	}
+	p.removeTus(u)
+}
+
+// flushSpill sends the spill file to S3 as the next part and empties it. The
+// multipart upload is only created for the first part, so small files end
+// up as a plain PUT in finishTus.
+func (p *proxy) flushSpill(ctx context.Context, u *tusUpload, f *os.File, size int64) error {
+	if u.UploadID == "" {
+		hdr := http.Header{}
+		if u.ContentType != "" {
+			hdr.Set("Content-Type", u.ContentType)
+		}
+		id, err := p.createMultipart(ctx, u.Bucket, u.Key, hdr)
+		if err != nil {
+			return err
+		}
+		u.UploadID = id
+		if err := p.saveTus(u); err != nil {
+			return err
+		}
+	}
+	var sum string
+	if p.global.VerifyChecksums {
+		var err error
+		if sum, err = sectionMD5(f, size); err != nil {
+			return err
+		}
+	}
+	n := len(u.Parts) + 1
+	etag, err := p.uploadPart(ctx, u.Bucket, u.Key, u.UploadID, n, io.NewSectionReader(f, 0, size), size, sum)
+	if err != nil {
+		return err
+	}
+	// Truncating before saving the state means a crash in between only
+	// rewinds the offset: the client resends and part n is uploaded again.
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	u.Parts = append(u.Parts, completedPart{PartNumber: n, ETag: etag})
+	u.PartsBytes += size
+	return p.saveTus(u)
+}
+
+func (p *proxy) finishTus(ctx context.Context, u *tusUpload, f *os.File, size int64) error {
+	if u.UploadID == "" {
+		data := make([]byte, size)
+		if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+			return err
+		}
+		ct := u.ContentType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		if err := p.putObjectBytes(ctx, u.Bucket, u.Key, ct, data); err != nil {
+			return err
+		}
+	} else {
+		if size > 0 {
+			if err := p.flushSpill(ctx, u, f, size); err != nil {
+				return err
+			}
+		}
+		if _, err := p.completeMultipart(ctx, u.Bucket, u.Key, u.UploadID, u.Parts); err != nil {
+			return err
+		}
+	}
+	u.Done = true
+	if err := p.saveTus(u); err != nil {
+		return err
+	}
+	return os.Remove(p.tusSpillPath(u.ID))
+}
+
+// appendTus writes body to the spill file, sending a part each time it
+// reaches the part size, and completes the object once Length bytes arrived.
+// Whatever was received before an error is kept.
+func (p *proxy) appendTus(ctx context.Context, u *tusUpload, body io.Reader) error {
+	f, err := os.OpenFile(p.tusSpillPath(u.ID), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	remaining := u.Length - u.PartsBytes - size
+	for remaining > 0 {
+		n, err := io.Copy(io.NewOffsetWriter(f, size), io.LimitReader(body, min(u.partSize()-size, remaining)))
+		size += n
+		remaining -= n
+		if size >= u.partSize() && remaining > 0 {
+			if ferr := p.flushSpill(ctx, u, f, size); ferr != nil {
+				return ferr
+			}
+			size = 0
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if remaining == 0 {
+		return p.finishTus(ctx, u, f, size)
+	}
+	return nil
+}
+
+// parseTusMetadata decodes the Upload-Metadata header: comma separated
+// "key base64(value)" pairs.
+func parseTusMetadata(h string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, " ")
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q: %v", k, err)
+		}
+		out[k] = string(b)
+	}
+	return out, nil
+}
+
+func setTusHeaders(h http.Header) {
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Upload-Metadata")
+}
+
+// handleTus serves the tus 1.0 protocol: POST /api/tus/ creates an upload,
+// HEAD and PATCH /api/tus/{id} report and advance its offset, DELETE drops
+// it. The target key comes from the "key" metadata, or "prefix" + "filename".
+func (p *proxy) handleTus(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w.Header())
+	max := int64(maxParts * maxPartSize)
+	if l := int64(p.global.Limits.MaxUploadSize); l > 0 {
+		max = min(max, l)
+	}
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tus"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.tusCreate(w, r)
+		return
+	}
+
+	unlock, ok := tusLock(id)
+	if !ok {
+		http.Error(w, "upload is busy", http.StatusLocked)
+		return
+	}
+	defer unlock()
+	u, err := p.loadTus(id)
+	if err == nil && u.Owner != "" && u.Owner != ownerName(r) {
+		err = errNotFound
+	}
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("tus state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := p.resolveBucket(w, r, u.Bucket); !ok {
+		return
+	}
+	if !p.authorize(w, r, actWrite, u.Bucket, u.Key) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(p.tusOffset(u), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+		if u.Metadata != "" {
+			w.Header().Set("Upload-Metadata", u.Metadata)
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		p.tusPatch(w, r, u)
+	case http.MethodDelete:
+		if u.UploadID != "" && !u.Done {
+			if err := p.abortMultipart(r.Context(), u.Bucket, u.Key, u.UploadID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+		p.removeTus(u)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *proxy) tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > maxParts*maxPartSize {
+		http.Error(w, fmt.Sprintf("Upload-Length too large (max %d bytes)", int64(maxParts*maxPartSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bucketName := meta["bucket"]
+	if bucketName == "" {
+		bucketName = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, bucketName)
+	if !ok {
+		return
+	}
+	key := meta["key"]
+	if key == "" && meta["filename"] != "" {
+		key = strings.TrimSuffix(meta["prefix"], "/") + "/" + meta["filename"]
+	}
+	if key, err = cleanKey(key); err != nil || key == "" {
+		http.Error(w, "metadata must name the key or filename", http.StatusBadRequest)
+		return
+	}
+	if !p.authorize(w, r, actWrite, bucket, key) {
+		return
+	}
+	ct := meta["contentType"]
+	if ct == "" {
+		ct = meta["filetype"]
+	}
+	if e := p.checkUpload(bucket, key, length, ct); e != nil {
+		e.write(w)
+		return
+	}
+	// creation-with-upload: the body already carries the first bytes.
+	withUpload := r.Header.Get("Content-Type") == "application/offset+octet-stream" || length == 0
+	body := io.Reader(r.Body)
+	if withUpload && length > 0 {
+		var e *uploadError
+		if body, e = p.sniffBody(bucket, key, ct, body); e != nil {
+			e.write(w)
+			return
+		}
+	}
+
+	p.pruneTus(r.Context())
+	now := time.Now().UTC()
+	u := &tusUpload{
+		ID:          newJournalID(),
+		Profile:     p.name,
+		Bucket:      bucket,
+		Key:         strings.TrimLeft(key, "/"),
+		Owner:       ownerName(r),
+		Length:      length,
+		PartSize:    partSizeFor(length, tusPartSize),
+		ContentType: ct,
+		Metadata:    r.Header.Get("Upload-Metadata"),
+		Created:     now,
+		Expires:     now.Add(tusExpiry),
+	}
+	// Held from before the state exists, so that no other request on the
+	// new upload runs alongside the first bytes.
+	unlock, _ := tusLock(u.ID)
+	defer unlock()
+	if err := p.saveTus(u); err != nil {
+		http.Error(w, fmt.Sprintf("tus state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	loc := strings.TrimSuffix(strings.SplitN(r.RequestURI, "?", 2)[0], "/") + "/" + u.ID
+	w.Header().Set("Location", loc)
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+
+	if withUpload {
+		if err := p.appendTus(r.Context(), u, body); err != nil {
+			log.Printf("tus %s: %v", u.ID, err)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(p.tusOffset(u), 10))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (p *proxy) tusPatch(w http.ResponseWriter, r *http.Request, u *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	off, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	if cur := p.tusOffset(u); off != cur {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(cur, 10))
+		http.Error(w, fmt.Sprintf("offset mismatch: upload is at %d", cur), http.StatusConflict)
+		return
+	}
+	if u.Done {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Length, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.ContentLength > 0 && off+r.ContentLength > u.Length {
+		http.Error(w, "body goes past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := io.Reader(r.Body)
+	if off == 0 {
+		var e *uploadError
+		if body, e = p.sniffBody(u.Bucket, u.Key, u.ContentType, body); e != nil {
+			e.write(w)
+			return
+		}
+	}
+	err = p.appendTus(r.Context(), u, body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(p.tusOffset(u), 10))
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	if err != nil {
+		log.Printf("tus %s: %v", u.ID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
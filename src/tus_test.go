@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTusTestProxy(t *testing.T) *proxy {
+	t.Helper()
+	c := cfg{StateDir: t.TempDir(), Profiles: map[string]profileCfg{
+		"test": {Endpoint: "http://127.0.0.1:1", Bucket: "bk", Buckets: []string{"bk"}},
+	}}
+	p, err := newProxy("test", c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func tusRequest(p *proxy, method, id string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/tus/"+id, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range hdr {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	p.handleTus(w, r)
+	return w
+}
+
+// TestTusConcurrentPatchDelete checks that a terminated upload stays gone:
+// no PATCH racing the DELETE may write to it afterwards.
+func TestTusConcurrentPatchDelete(t *testing.T) {
+	p := newTusTestProxy(t)
+	for i := 0; i < 50; i++ {
+		w := tusRequest(p, http.MethodPost, "", map[string]string{
+			"Upload-Length":   "1048576",
+			"Upload-Metadata": "key dGVzdC5iaW4=",
+		}, "")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
+		}
+		loc := w.Header().Get("Location")
+		id := loc[strings.LastIndex(loc, "/")+1:]
+
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 20; k++ {
+					h := tusRequest(p, http.MethodHead, id, nil, "")
+					if h.Code == http.StatusNotFound {
+						return
+					}
+					off := h.Header().Get("Upload-Offset")
+					if off == "" {
+						continue
+					}
+					pw := tusRequest(p, http.MethodPatch, id, map[string]string{
+						"Content-Type":  "application/offset+octet-stream",
+						"Upload-Offset": off,
+					}, strings.Repeat("x", 100))
+					switch pw.Code {
+					case http.StatusNoContent, http.StatusConflict, http.StatusLocked, http.StatusNotFound:
+					default:
+						t.Errorf("patch: %d %s", pw.Code, pw.Body)
+					}
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				switch d := tusRequest(p, http.MethodDelete, id, nil, ""); d.Code {
+				case http.StatusNoContent:
+					return
+				case http.StatusLocked:
+				default:
+					t.Errorf("delete: %d %s", d.Code, d.Body)
+					return
+				}
+			}
+		}()
+		wg.Wait()
+
+		for _, path := range []string{p.tusStatePath(id), p.tusSpillPath(id)} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("%s left behind after DELETE (%v)", path, err)
+			}
+		}
+		if h := tusRequest(p, http.MethodHead, id, nil, ""); h.Code != http.StatusNotFound {
+			t.Fatalf("HEAD after DELETE: %d", h.Code)
+		}
+	}
+	tusLocksMu.Lock()
+	n := len(tusLocks)
+	tusLocksMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d tus locks left", n)
+	}
+}
+
+func TestTusLockExclusive(t *testing.T) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		holders int
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 1000; k++ {
+				unlock, ok := tusLock("x" + strconv.Itoa(k%3))
+				if !ok {
+					continue
+				}
+				if k%3 == 0 {
+					mu.Lock()
+					holders++
+					if holders > 1 {
+						t.Error("two holders of one tus lock")
+					}
+					mu.Unlock()
+					mu.Lock()
+					holders--
+					mu.Unlock()
+				}
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(tusLocks) != 0 {
+		t.Errorf("%d tus locks left", len(tusLocks))
+	}
+}
+
+// TestTusLockHeldThroughRemove checks that removing an upload does not hand
+// its lock to another request while the remover still holds it.
+func TestTusLockHeldThroughRemove(t *testing.T) {
+	p := newTusTestProxy(t)
+	u := &tusUpload{ID: newJournalID(), Profile: p.name}
+	if err := p.saveTus(u); err != nil {
+		t.Fatal(err)
+	}
+	unlock, ok := tusLock(u.ID)
+	if !ok {
+		t.Fatal("lock of a new upload is busy")
+	}
+	p.removeTus(u)
+	if other, ok := tusLock(u.ID); ok {
+		other()
+		t.Fatal("lock handed out while its holder removes the upload")
+	}
+	unlock()
+	other, ok := tusLock(u.ID)
+	if !ok {
+		t.Fatal("lock still busy after unlock")
+	}
+	other()
+}
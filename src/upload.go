@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const (
+	uploadPartSize = 16 << 20
+	maxPartSize    = 5 << 30
+)
+
+type uploadedPart struct {
+	PartNumber int    `xml:"PartNumber" json:"partNumber"`
+	ETag       string `xml:"ETag" json:"etag"`
+	Size       int64  `xml:"Size" json:"size"`
+}
+
+// listParts returns every part uploaded so far, following pagination.
+func (p *proxy) listParts(ctx context.Context, bucket, key, uploadID string) ([]uploadedPart, error) {
+	var out []uploadedPart
+	marker := ""
+	for {
+		q := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			q.Set("part-number-marker", marker)
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, p.uploadURL(bucket, key, q), nil)
+		var res struct {
+			Parts                []uploadedPart `xml:"Part"`
+			IsTruncated          bool           `xml:"IsTruncated"`
+			NextPartNumberMarker string         `xml:"NextPartNumberMarker"`
+		}
+		if err := p.doXML(ctx, req, "list parts", &res); err != nil {
+			return nil, err
+		}
+		out = append(out, res.Parts...)
+		if !res.IsTruncated || res.NextPartNumberMarker == "" || res.NextPartNumberMarker == marker {
+			return out, nil
+		}
+		marker = res.NextPartNumberMarker
+	}
+}
+
+// uploadPart streams body as part n of the upload and returns its ETag.
+// With contentMD5 (base64), S3 checks the part and so does the proxy, on
+// the returned ETag; with verifyChecksums, the proxy checks the ETag against
+// the MD5 of what it sent.
+func (p *proxy) uploadPart(ctx context.Context, bucket, key, uploadID string, n int, body io.Reader, size int64, contentMD5 string) (string, error) {
+	var d *digestReader
+	if contentMD5 == "" && p.global.VerifyChecksums {
+		d = newDigestReader(body, false)
+		body = d
+	}
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, p.uploadURL(bucket, key, q), body)
+	req.ContentLength = size
+	if contentMD5 != "" {
+		req.Header.Set("Content-MD5", contentMD5)
+	}
+	resp, err := p.signAndDo(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var md5Hex string
+		if contentMD5 != "" {
+			sum, _ := base64.StdEncoding.DecodeString(contentMD5)
+			md5Hex = hex.EncodeToString(sum)
+		} else if d != nil {
+			md5Hex = d.md5Hex()
+		}
+		if md5Hex != "" {
+			if err := checkETag(resp.Header, md5Hex); err != nil {
+				return "", fmt.Errorf("part %d: %w", n, err)
+			}
+		}
+		return resp.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return "", fmt.Errorf("upload part %d failed: %w", n, errNotFound)
+	}
+	return "", fmt.Errorf("upload part %d failed: %s", n, resp.Status)
+}
+
+type multipartRequest struct {
+	Bucket      string          `json:"bucket,omitempty"`
+	Key         string          `json:"key"`
+	UploadID    string          `json:"uploadId,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Size        int64           `json:"size,omitempty"`
+	Parts       []completedPart `json:"parts,omitempty"`
+}
+
+type multipartResponse struct {
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	UploadID string         `json:"uploadId"`
+	PartSize int64          `json:"partSize,omitempty"`
+	ETag     string         `json:"etag,omitempty"`
+	Parts    []uploadedPart `json:"parts,omitempty"`
+}
+
+// multipartTarget reads the upload coordinates from the JSON body (POST) or
+// the query string (PUT, GET, DELETE) and checks write access to the key.
+func (p *proxy) multipartTarget(w http.ResponseWriter, r *http.Request, needID bool) (multipartRequest, string, bool) {
+	var req multipartRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return req, "", false
+		}
+	} else {
+		q := r.URL.Query()
+		req.Bucket, req.Key, req.UploadID = q.Get("bucket"), q.Get("key"), q.Get("uploadId")
+	}
+	if req.Bucket == "" {
+		req.Bucket = r.URL.Query().Get("bucket")
+	}
+	bucket, ok := p.resolveBucket(w, r, req.Bucket)
+	if !ok {
+		return req, "", false
+	}
+	var err error
+	if req.Key, err = cleanKey(req.Key); err != nil || req.Key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return req, "", false
+	}
+	if needID && req.UploadID == "" {
+		http.Error(w, "uploadId is required", http.StatusBadRequest)
+		return req, "", false
+	}
+	if !p.authorize(w, r, actWrite, bucket, req.Key) {
+		return req, "", false
+	}
+	return req, bucket, true
+}
+
+func writeMultipartError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// handleMultipartInitiate starts an upload and suggests a part size for the
+// announced object size.
+func (p *proxy) handleMultipartInitiate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, bucket, ok := p.multipartTarget(w, r, false)
+	if !ok {
+		return
+	}
+	if e := p.checkUpload(bucket, req.Key, req.Size, req.ContentType); e != nil {
+		e.write(w)
+		return
+	}
+	hdr := http.Header{}
+	if req.ContentType != "" {
+		hdr.Set("Content-Type", req.ContentType)
+	}
+	id, err := p.createMultipart(r.Context(), bucket, req.Key, hdr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(multipartResponse{Bucket: bucket, Key: req.Key, UploadID: id, PartSize: partSizeFor(req.Size, uploadPartSize)})
+}
+
+// handleMultipartPart forwards one part:
+// PUT /api/multipart/part?key=&uploadId=&partNumber= with the bytes as body.
+func (p *proxy) handleMultipartPart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, bucket, ok := p.multipartTarget(w, r, true)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxParts {
+		http.Error(w, fmt.Sprintf("partNumber must be between 1 and %d", maxParts), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > maxPartSize {
+		http.Error(w, fmt.Sprintf("part too large (max %d bytes)", maxPartSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if p.tooLarge(w, bucket, req.Key, r.ContentLength) {
+		return
+	}
+	body := io.Reader(r.Body)
+	if n == 1 {
+		var e *uploadError
+		if body, e = p.sniffBody(bucket, req.Key, "", body); e != nil {
+			e.write(w)
+			return
+		}
+	}
+	sums, err := checksumsFrom(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d := newDigestReader(body, sums.SHA256 != "")
+	etag, err := p.uploadPart(r.Context(), bucket, req.Key, req.UploadID, n, d, r.ContentLength, sums.MD5)
+	if err == nil {
+		err = sums.check(d)
+	}
+	if errors.Is(err, errChecksumMismatch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	_ = json.NewEncoder(w).Encode(completedPart{PartNumber: n, ETag: etag})
+}
+
+// handleMultipartComplete assembles the upload. Without a parts list it uses
+// every part S3 has. The upload is aborted if the result is over the size
+// limit.
+func (p *proxy) handleMultipartComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, bucket, ok := p.multipartTarget(w, r, true)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	uploaded, err := p.listParts(ctx, bucket, req.Key, req.UploadID)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	var total int64
+	for _, pt := range uploaded {
+		total += pt.Size
+	}
+	if p.tooLarge(w, bucket, req.Key, total) {
+		_ = p.abortMultipart(ctx, bucket, req.Key, req.UploadID)
+		return
+	}
+	parts := req.Parts
+	if len(parts) == 0 {
+		for _, pt := range uploaded {
+			parts = append(parts, completedPart{PartNumber: pt.PartNumber, ETag: pt.ETag})
+		}
+	}
+	etag, err := p.completeMultipart(ctx, bucket, req.Key, req.UploadID, parts)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(multipartResponse{Bucket: bucket, Key: req.Key, UploadID: req.UploadID, ETag: etag})
+}
+
+// handleMultipartAbort drops an upload and the parts already stored.
+func (p *proxy) handleMultipartAbort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, bucket, ok := p.multipartTarget(w, r, true)
+	if !ok {
+		return
+	}
+	if err := p.abortMultipart(r.Context(), bucket, req.Key, req.UploadID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMultipartParts lists the parts already uploaded, so that a client
+// can resume after a failure.
+func (p *proxy) handleMultipartParts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, bucket, ok := p.multipartTarget(w, r, true)
+	if !ok {
+		return
+	}
+	parts, err := p.listParts(r.Context(), bucket, req.Key, req.UploadID)
+	if err != nil {
+		writeMultipartError(w, err)
+		return
+	}
+	if parts == nil {
+		parts = []uploadedPart{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(multipartResponse{Bucket: bucket, Key: req.Key, UploadID: req.UploadID, Parts: parts})
+}
+
+// spillThreshold is how much of a PUT body without Content-Length is
+// buffered on disk before the proxy switches to a multipart upload. It is a
+// multiple of uploadPartSize so the spill file splits into whole parts.
+const spillThreshold = 4 * uploadPartSize
+
+// streamPartSize grows the part size every 1000 parts so that a stream of
+// unknown length can reach several hundred GiB within the part limit.
+func streamPartSize(n int) int64 {
+	return uploadPartSize * int64(1+(n-1)/1000)
+}
+
+// putStream stores a body of unknown length. Small bodies are spilled to a
+// temporary file and forwarded as a single PUT with a known length; larger
+// ones are sent as a multipart upload, one part buffered at a time.
+func (p *proxy) putStream(w http.ResponseWriter, r *http.Request, body io.Reader, bucket, key, pathUnescaped, rawPath, ct string, sums checksums) {
+	spill, err := os.CreateTemp("", "s3b-put-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("spill file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spill.Name())
+	defer spill.Close()
+
+	d := newDigestReader(body, sums.SHA256 != "")
+	n, err := io.Copy(spill, io.LimitReader(d, spillThreshold+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("read body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if p.tooLarge(w, bucket, key, n) {
+		return
+	}
+	if n <= spillThreshold {
+		if sums.any() || p.global.VerifyChecksums {
+			p.putChecked(w, r, pathUnescaped, rawPath, io.NewSectionReader(spill, 0, n), n, ct, sums)
+			return
+		}
+		p.forwardRaw(w, r, http.MethodPut, pathUnescaped, rawPath, "", io.NewSectionReader(spill, 0, n), n, ct)
+		return
+	}
+
+	ctx := r.Context()
+	hdr := http.Header{}
+	if ct != "" {
+		hdr.Set("Content-Type", ct)
+	}
+	id, err := p.createMultipart(ctx, bucket, key, hdr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	rest := io.MultiReader(io.NewSectionReader(spill, spillThreshold, n-spillThreshold), d)
+	etag, status, err := p.streamParts(ctx, bucket, key, id, spill, rest, func() error { return sums.check(d) })
+	if err != nil {
+		if aerr := p.abortMultipart(context.WithoutCancel(ctx), bucket, key, id); aerr != nil {
+			log.Printf("put %s: abort: %v", key, aerr)
+		}
+		var ue *uploadError
+		if errors.As(err, &ue) {
+			ue.write(w)
+		} else {
+			http.Error(w, err.Error(), status)
+		}
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// streamParts uploads the spilled head as the first parts, then cuts the
+// rest of the body into parts buffered in a second temporary file. check
+// runs once the whole body is read, before the upload is completed.
+func (p *proxy) streamParts(ctx context.Context, bucket, key, id string, head *os.File, rest io.Reader, check func() error) (string, int, error) {
+	var (
+		parts []completedPart
+		total int64
+	)
+	rule := p.uploadRule(bucket, key)
+	limit := p.uploadLimit(rule)
+	send := func(body io.ReaderAt, size int64) error {
+		n := len(parts) + 1
+		if n > maxParts {
+			return fmt.Errorf("too many parts")
+		}
+		var sum string
+		if p.global.VerifyChecksums {
+			var err error
+			if sum, err = sectionMD5(body, size); err != nil {
+				return err
+			}
+		}
+		etag, err := p.uploadPart(ctx, bucket, key, id, n, io.NewSectionReader(body, 0, size), size, sum)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: n, ETag: etag})
+		total += size
+		return nil
+	}
+	for off := int64(0); off < spillThreshold; off += uploadPartSize {
+		if err := send(io.NewSectionReader(head, off, uploadPartSize), uploadPartSize); err != nil {
+			return "", http.StatusBadGateway, err
+		}
+	}
+
+	buf, err := os.CreateTemp("", "s3b-part-*")
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	defer os.Remove(buf.Name())
+	defer buf.Close()
+	for {
+		if err := buf.Truncate(0); err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		n, err := io.Copy(io.NewOffsetWriter(buf, 0), io.LimitReader(rest, streamPartSize(len(parts)+1)))
+		if err != nil {
+			return "", http.StatusBadRequest, fmt.Errorf("read body: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+		if limit > 0 && total+n > limit {
+			return "", http.StatusRequestEntityTooLarge, newUploadError(rule, key, http.StatusRequestEntityTooLarge, "too_large", "object too large (max %d bytes)", limit)
+		}
+		if err := send(buf, n); err != nil {
+			return "", http.StatusBadGateway, err
+		}
+	}
+	if err := check(); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	etag, err := p.completeMultipart(ctx, bucket, key, id, parts)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	return etag, http.StatusOK, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const sniffLen = 512
+
+// uploadRule restricts what may be stored under Prefix. The most specific
+// rule (longest prefix) matching the profile, bucket and key applies. An
+// empty Profile or Bucket matches every profile or bucket.
+type uploadRule struct {
+	Profile           string   `yaml:"profile" json:"profile,omitempty"`
+	Bucket            string   `yaml:"bucket" json:"bucket,omitempty"`
+	Prefix            string   `yaml:"prefix" json:"prefix"`
+	MaxSize           byteSize `yaml:"maxSize" json:"maxSize,omitempty"`
+	AllowedTypes      []string `yaml:"allowedTypes" json:"allowedTypes,omitempty"`
+	AllowedExtensions []string `yaml:"allowedExtensions" json:"allowedExtensions,omitempty"`
+	ForbiddenChars    string   `yaml:"forbiddenChars" json:"forbiddenChars,omitempty"`
+	MaxKeyLength      int      `yaml:"maxKeyLength" json:"maxKeyLength,omitempty"`
+}
+
+func (u *uploadRule) normalize() error {
+	var errs []error
+	u.Prefix = strings.TrimLeft(u.Prefix, "/")
+	for i, t := range u.AllowedTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if base, sub, ok := strings.Cut(t, "/"); !ok || base == "" || sub == "" {
+			errs = append(errs, fmt.Errorf("allowedTypes: invalid type %q", t))
+		}
+		u.AllowedTypes[i] = t
+	}
+	for i, e := range u.AllowedExtensions {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" && !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		u.AllowedExtensions[i] = e
+	}
+	if u.MaxKeyLength < 0 {
+		errs = append(errs, fmt.Errorf("maxKeyLength: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (u *uploadRule) matches(profile, bucket, key string) bool {
+	return (u.Profile == "" || u.Profile == profile) &&
+		(u.Bucket == "" || u.Bucket == bucket) &&
+		strings.HasPrefix(key, u.Prefix)
+}
+
+// uploadRule returns the rule that applies to key, or nil.
+func (p *proxy) uploadRule(bucket, key string) *uploadRule {
+	key = strings.TrimLeft(key, "/")
+	var best *uploadRule
+	for i := range p.global.Limits.Uploads {
+		r := &p.global.Limits.Uploads[i]
+		if r.matches(p.name, bucket, key) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// uploadLimit is the largest object accepted for key, 0 meaning no limit.
+func (p *proxy) uploadLimit(rule *uploadRule) int64 {
+	max := int64(p.global.Limits.MaxUploadSize)
+	if rule != nil && rule.MaxSize > 0 && (max == 0 || int64(rule.MaxSize) < max) {
+		max = int64(rule.MaxSize)
+	}
+	return max
+}
+
+// uploadError is answered as JSON so that clients can tell which rule
+// refused the object.
+type uploadError struct {
+	status  int
+	Code    string `json:"error"`
+	Message string `json:"message"`
+	Key     string `json:"key"`
+	Prefix  string `json:"rulePrefix,omitempty"`
+}
+
+func (e *uploadError) Error() string { return e.Message }
+
+func (e *uploadError) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+func newUploadError(rule *uploadRule, key string, status int, code, format string, args ...any) *uploadError {
+	e := &uploadError{status: status, Code: code, Message: fmt.Sprintf(format, args...), Key: key}
+	if rule != nil {
+		e.Prefix = rule.Prefix
+	}
+	return e
+}
+
+// checkKey applies the key rules: length, forbidden characters, extension.
+func checkKey(rule *uploadRule, key string) *uploadError {
+	if rule == nil {
+		return nil
+	}
+	key = strings.TrimLeft(key, "/")
+	if rule.MaxKeyLength > 0 && len(key) > rule.MaxKeyLength {
+		return newUploadError(rule, key, http.StatusBadRequest, "key_too_long", "key is %d bytes long (max %d)", len(key), rule.MaxKeyLength)
+	}
+	if i := strings.IndexAny(key, rule.ForbiddenChars); rule.ForbiddenChars != "" && i >= 0 {
+		return newUploadError(rule, key, http.StatusBadRequest, "forbidden_character", "key contains forbidden character %q", key[i:i+1])
+	}
+	if len(rule.AllowedExtensions) > 0 {
+		ext := strings.ToLower(path.Ext(key))
+		if !containsString(rule.AllowedExtensions, ext) {
+			return newUploadError(rule, key, http.StatusUnsupportedMediaType, "extension_not_allowed", "extension %q is not allowed (allowed: %s)", ext, strings.Join(rule.AllowedExtensions, ", "))
+		}
+	}
+	return nil
+}
+
+func typeAllowed(allowed []string, ct string) bool {
+	base, _, _ := mime.ParseMediaType(ct)
+	if base == "" {
+		base = strings.ToLower(strings.TrimSpace(ct))
+	}
+	for _, a := range allowed {
+		if a == base || a == "*/*" || (strings.HasSuffix(a, "/*") && strings.HasPrefix(base, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpload applies the rule that covers key, and the global size limit,
+// to an upload of size bytes (-1 when unknown) declared as contentType.
+func (p *proxy) checkUpload(bucket, key string, size int64, contentType string) *uploadError {
+	rule := p.uploadRule(bucket, key)
+	if e := checkKey(rule, key); e != nil {
+		return e
+	}
+	if max := p.uploadLimit(rule); max > 0 && size > max {
+		return newUploadError(rule, key, http.StatusRequestEntityTooLarge, "too_large", "object too large: %d bytes (max %d)", size, max)
+	}
+	if rule != nil && len(rule.AllowedTypes) > 0 && contentType != "" && !typeAllowed(rule.AllowedTypes, contentType) {
+		return newUploadError(rule, key, http.StatusUnsupportedMediaType, "type_not_allowed", "content type %q is not allowed (allowed: %s)", contentType, strings.Join(rule.AllowedTypes, ", "))
+	}
+	return nil
+}
+
+func baseType(ct string) string {
+	base, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(ct))
+	}
+	return base
+}
+
+// zipTypes are formats stored as ZIP files, which the sniffer reports as
+// application/zip.
+var zipTypes = []string{"application/zip", "application/x-zip-compressed", "application/java-archive", "application/vnd.android.package-archive", "application/vnd.ms-xpsdocument"}
+
+// textTypes are application types made of text, which the sniffer reports
+// as text/plain.
+var textTypes = []string{"application/json", "application/xml", "application/javascript", "application/yaml", "application/x-yaml", "application/x-ndjson", "application/toml", "application/sql"}
+
+func isZipType(t string) bool {
+	return containsString(zipTypes, t) || strings.HasSuffix(t, "+zip") ||
+		strings.HasPrefix(t, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(t, "application/vnd.oasis.opendocument.")
+}
+
+func isTextType(t string) bool {
+	return strings.HasPrefix(t, "text/") || containsString(textTypes, t) ||
+		strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml") || strings.HasSuffix(t, "+yaml")
+}
+
+// isExecutable recognizes native executables, which the sniffer reports as
+// application/octet-stream like any unknown binary.
+func isExecutable(head []byte) bool {
+	for _, magic := range []string{"\x7fELF", "MZ", "\xfe\xed\xfa\xce", "\xfe\xed\xfa\xcf", "\xce\xfa\xed\xfe", "\xcf\xfa\xed\xfe", "\xca\xfe\xba\xbe"} {
+		if bytes.HasPrefix(head, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffCompatible reports whether sniffed, one of the generic types that
+// http.DetectContentType falls back to, can be content of type declared.
+func sniffCompatible(sniffed, declared string, head []byte) bool {
+	switch sniffed {
+	case "application/octet-stream":
+		return !isExecutable(head)
+	case "text/plain":
+		return isTextType(declared)
+	case "text/xml", "application/xml":
+		return declared == "text/xml" || declared == "application/xml" || strings.HasSuffix(declared, "+xml")
+	case "application/zip":
+		return isZipType(declared)
+	}
+	return false
+}
+
+// sniffBody checks the type of the first bytes of body against the allowed
+// types of the rule for key, and returns a reader that still yields the
+// whole body. The sniffer only knows a few formats: when it answers with a
+// generic type (text/plain for JSON or CSV, application/zip for DOCX, ...),
+// the declared type, or else the one of the extension, must be allowed and
+// compatible with it. An executable never passes for another type.
+func (p *proxy) sniffBody(bucket, key, declared string, body io.Reader) (io.Reader, *uploadError) {
+	rule := p.uploadRule(bucket, key)
+	if rule == nil || len(rule.AllowedTypes) == 0 {
+		return body, nil
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, newUploadError(rule, key, http.StatusBadRequest, "read_error", "read body: %v", err)
+	}
+	head = head[:n]
+	ct := http.DetectContentType(head)
+	if typeAllowed(rule.AllowedTypes, ct) && !(baseType(ct) == "application/octet-stream" && isExecutable(head)) {
+		return io.MultiReader(bytes.NewReader(head), body), nil
+	}
+	declared = baseType(declared)
+	if declared == "" || declared == "application/octet-stream" {
+		declared = baseType(mime.TypeByExtension(path.Ext(key)))
+	}
+	if declared != "" && typeAllowed(rule.AllowedTypes, declared) && sniffCompatible(baseType(ct), declared, head) {
+		return io.MultiReader(bytes.NewReader(head), body), nil
+	}
+	return nil, newUploadError(rule, key, http.StatusUnsupportedMediaType, "type_not_allowed", "content looks like %q, which is not allowed (allowed: %s)", ct, strings.Join(rule.AllowedTypes, ", "))
+}
+
+// checkDestinations applies the key rules to to+rel for every rel, so that
+// folder renames and copies cannot create names an upload would be refused.
+// Refused keys are reported as failures against their source key.
+func (p *proxy) checkDestinations(ctx context.Context, bucket, from, to string, rels []string, sizes map[string]int64) ([]string, []keyError) {
+	pr := progressFrom(ctx)
+	ok := make([]string, 0, len(rels))
+	var refused []keyError
+	for _, rel := range rels {
+		if e := checkKey(p.uploadRule(bucket, to+rel), to+rel); e != nil {
+			pr.step(from+rel, sizes[rel], e)
+			refused = append(refused, keyError{Key: from + rel, Error: e.Message})
+			continue
+		}
+		ok = append(ok, rel)
+	}
+	return ok, refused
+}
+
+// tooLarge answers 413 when size is over the limit that applies to key.
+func (p *proxy) tooLarge(w http.ResponseWriter, bucket, key string, size int64) bool {
+	rule := p.uploadRule(bucket, key)
+	if max := p.uploadLimit(rule); max > 0 && size > max {
+		newUploadError(rule, key, http.StatusRequestEntityTooLarge, "too_large", "object too large: %d bytes (max %d)", size, max).write(w)
+		return true
+	}
+	return false
+}
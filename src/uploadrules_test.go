@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSniffBody(t *testing.T) {
+	p := &proxy{global: cfg{Limits: limitsCfg{Uploads: []uploadRule{
+		{Prefix: "images/", AllowedTypes: []string{"image/*"}},
+		{Prefix: "data/", AllowedTypes: []string{"application/json", "text/csv", "application/yaml"}},
+		{Prefix: "docs/", AllowedTypes: []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"}},
+		{Prefix: "bin/", AllowedTypes: []string{"application/octet-stream"}},
+	}}}}
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	svg := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`
+	zip := "PK\x03\x04\x14\x00\x00\x00"
+	elf := "\x7fELF\x02\x01\x01\x00"
+	for _, tc := range []struct {
+		key, declared, body string
+		ok                  bool
+	}{
+		{"images/a.png", "image/png", png, true},
+		{"images/a.png", "", png, true},
+		{"images/a.svg", "image/svg+xml", svg, true},
+		{"images/a.svg", "", svg, true},
+		{"images/a.png", "image/png", "<html><body>hi</body></html>", false},
+		{"images/a.png", "image/png", elf, false},
+		{"images/a.png", "image/png", "just text", false},
+		{"images/a.raw", "image/x-raw", "\x00\x01\x02\x03", true},
+		{"data/a.json", "application/json", `{"a": 1}`, true},
+		{"data/a.json", "", `{"a": 1}`, true},
+		{"data/a.csv", "text/csv", "a,b\n1,2\n", true},
+		{"data/a.yaml", "application/yaml", "a: 1\n", true},
+		{"data/a.json", "application/json", png, false},
+		{"data/a.json", "application/json", "<!DOCTYPE html><p>x", false},
+		{"docs/a.docx", "", zip, true},
+		{"docs/a.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", zip, true},
+		{"docs/a.docx", "", "plain words", false},
+		{"bin/a.dat", "", "\x00\x01\x02\x03", true},
+		{"bin/a.exe", "", "MZ\x90\x00", false},
+		{"other/a.exe", "", "MZ\x90\x00", true},
+	} {
+		body, e := p.sniffBody("b", tc.key, tc.declared, strings.NewReader(tc.body))
+		if (e == nil) != tc.ok {
+			t.Errorf("sniffBody(%q, %q) = %v, want ok %v", tc.key, tc.declared, e, tc.ok)
+			continue
+		}
+		if e != nil {
+			continue
+		}
+		if got, _ := io.ReadAll(body); string(got) != tc.body {
+			t.Errorf("sniffBody(%q) body = %q, want %q", tc.key, got, tc.body)
+		}
+	}
+}